@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"local/tfmerge"
+
+	"github.com/urfave/cli/v2"
+)
+
+// convertShowJSON is the convert command: it builds a state file from each `terraform show -json` document.
+// The fields that can't be recovered are reported on stderr.
+func convertShowJSON(ctx *cli.Context) error {
+	return transformStateFiles(ctx, "stdin.json", func(path string, b []byte) ([]byte, string, error) {
+		b, report, err := tfmerge.ConvertShowJSON(b)
+		if err != nil {
+			return nil, "", fmt.Errorf("converting %s: %v", path, err)
+		}
+		for _, w := range report.Warnings {
+			fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", path, w)
+		}
+		// e.g. prod.json is converted to prod.tfstate
+		return b, strings.TrimSuffix(path, filepath.Ext(path)) + ".tfstate", nil
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+)
+
+// defaultStateFileMode is the mode of the new state files, as they contain secrets
+const defaultStateFileMode = 0600
+
+// writeStateFile writes the state file atomically: the content goes to a temporary file in the same directory, which is
+// synced then renamed over the state file. So a crash never leaves a truncated state file behind.
+// A new state file is only readable by its owner, an existing one keeps its mode.
+func writeStateFile(path string, b []byte) error {
+	_, err := replaceStateFile(path, b, false)
+	return err
+}
+
+// replaceStateFile is writeStateFile, if lock is set the new state file is OS locked before it's renamed into place,
+// and returned open to hold the lock.
+func replaceStateFile(path string, b []byte, lock bool) (_ *os.File, err error) {
+	mode := iofs.FileMode(defaultStateFileMode)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	} else if !errors.Is(err, iofs.ErrNotExist) {
+		return nil, err
+	}
+
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+name+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err = f.Chmod(mode); err != nil {
+		return nil, err
+	}
+	if _, err = f.Write(b); err != nil {
+		return nil, err
+	}
+	if err = f.Sync(); err != nil {
+		return nil, err
+	}
+	if lock {
+		if err = osLock(f); err != nil {
+			return nil, err
+		}
+	} else if err = f.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return nil, err
+	}
+
+	// Persist the rename as well, not supported on every platform
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	if lock {
+		return f, nil
+	}
+	return nil, nil
+}
+
+// transformStateFiles runs the transform on each state file of the command's arguments ("-" for stdin, named stdinName),
+// which may be encrypted and/or compressed. The transform returns the new content and its file name.
+// A single state file is printed to stdout, or they are written to --out-dir by their base name (encrypted to the recipients, if any).
+func transformStateFiles(ctx *cli.Context, stdinName string, transform func(path string, b []byte) ([]byte, string, error)) error {
+	paths := ctx.Args().Slice()
+	outDir := ctx.String("out-dir")
+	if len(paths) == 0 {
+		return fmt.Errorf("no state file is given")
+	}
+	if len(paths) > 1 && outDir == "" {
+		return fmt.Errorf("--out-dir is needed for multiple state files")
+	}
+	keys, err := loadAgeKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		var b []byte
+		if path == "-" {
+			b, err = io.ReadAll(os.Stdin)
+			path = stdinName
+		} else {
+			b, err = os.ReadFile(path)
+		}
+		if err == nil {
+			b, err = keys.decode(b)
+		}
+		if err != nil {
+			return fmt.Errorf("reading state file %s: %v", path, err)
+		}
+		if b, path, err = transform(path, b); err != nil {
+			return err
+		}
+		if b, err = keys.encrypt(b); err != nil {
+			return err
+		}
+		if outDir == "" {
+			fmt.Print(string(b))
+			continue
+		}
+		if err := os.MkdirAll(outDir, 0700); err != nil {
+			return err
+		}
+		if err := writeStateFile(filepath.Join(outDir, filepath.Base(path)), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteStateFile(t *testing.T) {
+	dir := t.TempDir()
+	requireFile := func(path, content string, mode os.FileMode) {
+		t.Helper()
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, content, string(b))
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, mode, fi.Mode().Perm())
+	}
+
+	// A new state file is only readable by its owner
+	path := filepath.Join(dir, "new.tfstate")
+	require.NoError(t, writeStateFile(path, []byte("v1")))
+	requireFile(path, "v1", defaultStateFileMode)
+
+	// An existing state file keeps its mode
+	path = filepath.Join(dir, "existing.tfstate")
+	require.NoError(t, os.WriteFile(path, []byte("v1"), 0644))
+	require.NoError(t, os.Chmod(path, 0640))
+	require.NoError(t, writeStateFile(path, []byte("v2")))
+	requireFile(path, "v2", 0640)
+
+	// The temporary file is removed if the state file can't be replaced
+	path = filepath.Join(dir, "dir.tfstate")
+	require.NoError(t, os.Mkdir(path, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(path, "file"), nil, 0600))
+	require.Error(t, writeStateFile(path, []byte("v1")))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.Equal(t, []string{"dir.tfstate", "existing.tfstate", "new.tfstate"}, names, "no temporary file is left behind")
+}
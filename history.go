@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"local/tfmerge"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+)
+
+// ------------------| History: FNs |------------------
+// Each write (--output) or push (--push) of a merged state is recorded in the .tfmerge directory of the working directory:
+//   - <id>.tfstate : the backup of the state that is replaced, i.e. the base state for a push or the previous output file
+//   - <id>.json    : the manifest of the record
+//
+// The ids sort in time order, so `tfmerge undo` can restore the most recent record.
+
+const (
+	historyDir = ".tfmerge"
+	// backendTarget is the target of the records of a push
+	backendTarget = "backend"
+)
+
+// stateVersion identifies a snapshot of a state
+type stateVersion struct {
+	Serial  int    `json:"serial"`
+	Lineage string `json:"lineage"`
+}
+
+func readStateVersion(b []byte, keys *ageKeys) (stateVersion, error) {
+	var v stateVersion
+	if len(b) == 0 {
+		return v, nil
+	}
+	b, err := keys.decode(b)
+	if err != nil {
+		return v, err
+	}
+	err = json.Unmarshal(b, &v)
+	return v, err
+}
+
+type manifest struct {
+	Time   time.Time    `json:"time"`
+	Target string       `json:"target"`           // "backend", or the absolute path of the output file
+	Backup string       `json:"backup,omitempty"` // The backup file name, empty if there was no state before (e.g. a new output file)
+	Base   stateVersion `json:"base"`             // The backed up state
+	Merged stateVersion `json:"merged"`           // The state written by tfmerge
+	// Encrypted is whether the backup has been encrypted by tfmerge, i.e. the backed up state was in plaintext
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// record is a manifest recorded in the history directory dir
+type record struct {
+	dir string
+	id  string
+	manifest
+}
+
+// backupPath returns the path of the backup file, empty if there is none
+func (r *record) backupPath() string {
+	if r.Backup == "" {
+		return ""
+	}
+	return filepath.Join(r.dir, r.Backup)
+}
+
+// remove removes the record and its backup, e.g. once undone or if the merged state it records failed to be written
+func (r *record) remove() {
+	os.Remove(filepath.Join(r.dir, r.id+".json"))
+	if r.Backup != "" {
+		os.Remove(r.backupPath())
+	}
+}
+
+// recordHistory backs up the state that is about to be replaced by the merged state, and records the manifest.
+// With age recipients, the backup is encrypted to them.
+// The record must be removed if the merged state fails to be written, as undo refuses to restore a target that doesn't match it.
+func recordHistory(wd, target string, previous, merged []byte, keys *ageKeys) (*record, error) {
+	dir := filepath.Join(wd, historyDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating the history directory: %v", err)
+	}
+	now := time.Now().UTC()
+	r := &record{dir: dir, id: now.Format("20060102T150405.000000000Z"), manifest: manifest{Time: now, Target: target}}
+
+	var err error
+	// The version of the backup is only informational, an encrypted one is backed up as is even without identity
+	if r.Base, err = readStateVersion(previous, keys); err != nil && !(tfmerge.IsEncrypted(previous) && len(keys.identities) == 0) {
+		return nil, fmt.Errorf("reading the state to back up: %v", err)
+	}
+	if r.Merged, err = readStateVersion(merged, keys); err != nil {
+		return nil, fmt.Errorf("reading the merged state: %v", err)
+	}
+	if len(previous) != 0 {
+		r.Backup = r.id + ".tfstate"
+		r.Encrypted = !tfmerge.IsEncrypted(previous) && len(keys.recipients) != 0
+		backup, err := keys.encrypt(previous)
+		if err != nil {
+			return nil, fmt.Errorf("backing up the state: %v", err)
+		}
+		if err := writeStateFile(r.backupPath(), backup); err != nil {
+			return nil, fmt.Errorf("backing up the state: %v", err)
+		}
+	}
+	b, err := json.MarshalIndent(r.manifest, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, r.id+".json"), append(b, '\n'), 0600)
+	}
+	if err != nil {
+		r.remove()
+		return nil, fmt.Errorf("recording the manifest: %v", err)
+	}
+	return r, nil
+}
+
+// latestRecord returns the most recent record
+func latestRecord(wd string) (*record, error) {
+	dir := filepath.Join(wd, historyDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(entry.Name(), ".json"))
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("nothing to undo, no merged state has been written or pushed from %s", wd)
+	}
+	sort.Strings(ids)
+	id := ids[len(ids)-1]
+	b, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	r := &record{dir: dir, id: id}
+	if err := json.Unmarshal(b, &r.manifest); err != nil {
+		return nil, fmt.Errorf("reading the manifest %s: %v", id, err)
+	}
+	return r, nil
+}
+
+// undo restores the backup of the most recent record, if the target hasn't changed since it was written by tfmerge.
+// A restored backend state gets the serial after the current one, so the backend accepts it.
+// A restored file is decrypted if it was in plaintext before the merge.
+func undo(ctx context.Context, tfs *terraformSession, keys *ageKeys, lockTimeout time.Duration) error {
+	m, err := latestRecord(tfs.wd)
+	if err != nil {
+		return err
+	}
+
+	var tf *tfexec.Terraform
+	var lock *stateLock
+	var current []byte
+	if m.Target == backendTarget {
+		if tf, err = tfs.get(ctx); err != nil {
+			return err
+		}
+		state, err := tf.StatePull(ctx)
+		if err != nil {
+			return fmt.Errorf("pulling state file of the working directory: %v", err)
+		}
+		current = []byte(state)
+	} else {
+		if lock, err = lockStateFile(ctx, m.Target, lockTimeout); err != nil {
+			return err
+		}
+		defer lock.unlock()
+		if current, err = lock.read(); err != nil {
+			return err
+		}
+	}
+	v, err := readStateVersion(current, keys)
+	if err != nil {
+		return fmt.Errorf("reading the current state: %v", err)
+	}
+	if v != m.Merged {
+		return fmt.Errorf("refusing to undo, the state of %s has changed since the merge at %s (serial %d, lineage %q, was serial %d, lineage %q)",
+			m.Target, m.Time.Format(time.RFC3339), v.Serial, v.Lineage, m.Merged.Serial, m.Merged.Lineage)
+	}
+
+	var backup []byte
+	if m.Backup != "" {
+		if backup, err = os.ReadFile(m.backupPath()); err != nil {
+			return fmt.Errorf("reading the backup: %v", err)
+		}
+	}
+
+	switch {
+	case m.Target == backendTarget:
+		if len(backup) == 0 {
+			return fmt.Errorf("refusing to undo, there was no state in the backend before the merge at %s", m.Time.Format(time.RFC3339))
+		}
+		plain, err := keys.decode(backup)
+		if err != nil {
+			return fmt.Errorf("reading the backup: %v", err)
+		}
+		restored, err := tfmerge.SetSerial(plain, v.Serial+1)
+		if err != nil {
+			return fmt.Errorf("bumping the serial of the backup: %v", err)
+		}
+		if err := pushFile(ctx, tf, restored, lockTimeout, keys); err != nil {
+			return err
+		}
+	case len(backup) == 0:
+		if err := os.Remove(m.Target); err != nil {
+			return err
+		}
+	default:
+		// The compression of the backup is kept, as it's the one of the file name
+		if m.Encrypted {
+			if backup, err = tfmerge.Decrypt(backup, keys.identities); err != nil {
+				return fmt.Errorf("reading the backup: %v", err)
+			}
+		}
+		if err := lock.write(backup); err != nil {
+			return err
+		}
+	}
+
+	// The record is done with, so the next undo goes one step further back
+	m.remove()
+	fmt.Fprintf(os.Stderr, "Restored the state of %s from before the merge at %s\n", m.Target, m.Time.Format(time.RFC3339))
+	return nil
+}
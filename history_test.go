@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"local/tfmerge"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordHistory(t *testing.T) {
+	wd := t.TempDir()
+	keys := &ageKeys{}
+	_, err := latestRecord(wd)
+	require.ErrorContains(t, err, "nothing to undo")
+
+	previous := []byte(`{"version": 4, "serial": 1, "lineage": "aaaa"}`)
+	merged := []byte(`{"version": 4, "serial": 2, "lineage": "aaaa"}`)
+	r, err := recordHistory(wd, backendTarget, previous, merged, keys)
+	require.NoError(t, err)
+	b, err := os.ReadFile(r.backupPath())
+	require.NoError(t, err)
+	require.Equal(t, previous, b)
+
+	latest, err := latestRecord(wd)
+	require.NoError(t, err)
+	require.Equal(t, r.id, latest.id)
+	require.Equal(t, backendTarget, latest.Target)
+	require.Equal(t, stateVersion{Serial: 1, Lineage: "aaaa"}, latest.Base)
+	require.Equal(t, stateVersion{Serial: 2, Lineage: "aaaa"}, latest.Merged)
+	require.Equal(t, r.backupPath(), latest.backupPath())
+
+	// Nothing to back up for a new output file
+	target := filepath.Join(wd, "out.tfstate")
+	r2, err := recordHistory(wd, target, nil, merged, keys)
+	require.NoError(t, err)
+	require.Empty(t, r2.backupPath())
+	latest, err = latestRecord(wd)
+	require.NoError(t, err)
+	require.Equal(t, target, latest.Target)
+
+	// Removing a record makes the previous one the latest
+	r2.remove()
+	latest, err = latestRecord(wd)
+	require.NoError(t, err)
+	require.Equal(t, r.id, latest.id)
+	r.remove()
+	entries, err := os.ReadDir(filepath.Join(wd, historyDir))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestUndoEncryptedBackup(t *testing.T) {
+	wd := t.TempDir()
+	ctx := context.Background()
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	keys := &ageKeys{recipients: []age.Recipient{identity.Recipient()}}
+
+	// The plaintext output file is backed up encrypted
+	path := filepath.Join(wd, "out.tfstate")
+	previous := []byte(`{"version": 4, "serial": 1, "lineage": "aaaa"}`)
+	require.NoError(t, os.WriteFile(path, previous, 0600))
+	require.NoError(t, writeOutput(ctx, wd, path, []byte(`{"version": 4, "serial": 2, "lineage": "aaaa"}`), 0, keys))
+	r, err := latestRecord(wd)
+	require.NoError(t, err)
+	require.True(t, r.Encrypted)
+	b, err := os.ReadFile(r.backupPath())
+	require.NoError(t, err)
+	require.True(t, tfmerge.IsEncrypted(b))
+
+	// The output is restored in plaintext, which needs the identity
+	err = undo(ctx, &terraformSession{wd: wd}, keys, 0)
+	require.ErrorContains(t, err, "no identity")
+	keys.identities = []age.Identity{identity}
+	require.NoError(t, undo(ctx, &terraformSession{wd: wd}, keys, 0))
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, previous, b)
+
+	// An encrypted output is restored as is
+	encrypted, err := keys.encrypt(previous)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, encrypted, 0600))
+	require.NoError(t, writeOutput(ctx, wd, path, []byte(`{"version": 4, "serial": 2, "lineage": "aaaa"}`), 0, keys))
+	r, err = latestRecord(wd)
+	require.NoError(t, err)
+	require.False(t, r.Encrypted)
+	require.NoError(t, undo(ctx, &terraformSession{wd: wd}, keys, 0))
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, encrypted, b)
+}
+
+func TestUndoFile(t *testing.T) {
+	wd := t.TempDir()
+	ctx := context.Background()
+	keys := &ageKeys{}
+	tfs := &terraformSession{wd: wd}
+	path := filepath.Join(wd, "out.tfstate")
+	merged := []byte(`{"version": 4, "serial": 2, "lineage": "aaaa"}`)
+
+	// A new output file is removed
+	require.NoError(t, writeOutput(ctx, wd, path, merged, 0, keys))
+	require.NoError(t, undo(ctx, tfs, keys, 0))
+	_, err := os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	// The previous output file is restored, with its mode
+	previous := []byte(`{"version": 4, "serial": 1, "lineage": "aaaa"}`)
+	require.NoError(t, os.WriteFile(path, previous, 0640))
+	require.NoError(t, writeOutput(ctx, wd, path, merged, 0, keys))
+	require.NoError(t, undo(ctx, tfs, keys, 0))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, previous, b)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+	_, err = latestRecord(wd)
+	require.ErrorContains(t, err, "nothing to undo")
+
+	// The output file changed since the merge
+	require.NoError(t, writeOutput(ctx, wd, path, merged, 0, keys))
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 4, "serial": 3, "lineage": "aaaa"}`), 0640))
+	require.ErrorContains(t, undo(ctx, tfs, keys, 0), "has changed since the merge")
+	_, err = latestRecord(wd)
+	require.NoError(t, err, "the record is kept")
+}
@@ -0,0 +1,55 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"local/tfmerge"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUndoBackend(t *testing.T) {
+	wd := t.TempDir()
+	ctx := context.Background()
+	tf, backend := fakeTerraform(t, wd)
+	tfs := &terraformSession{wd: wd, tf: tf}
+	keys := &ageKeys{}
+	statePath := filepath.Join(backend, "backend.tfstate")
+
+	pulled, err := tfmerge.SetSerial([]byte(`{"version": 4, "serial": 1, "lineage": "aaaa", "outputs": {}, "resources": []}`), 1)
+	require.NoError(t, err)
+	merged, err := tfmerge.SetSerial(pulled, 2)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(statePath, pulled, 0600))
+	require.NoError(t, pushState(ctx, tf, pulled, merged, 0, keys))
+
+	// The backup gets the serial after the current one
+	require.NoError(t, undo(ctx, tfs, keys, 0))
+	b, err := os.ReadFile(statePath)
+	require.NoError(t, err)
+	expect, err := tfmerge.SetSerial(pulled, 3)
+	require.NoError(t, err)
+	require.Equal(t, string(expect), string(b))
+	_, err = latestRecord(wd)
+	require.ErrorContains(t, err, "nothing to undo")
+
+	// The backend state changed since the merge
+	require.NoError(t, pushState(ctx, tf, expect, merged, 0, keys))
+	changed, err := tfmerge.SetSerial(pulled, 5)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(statePath, changed, 0600))
+	require.ErrorContains(t, undo(ctx, tfs, keys, 0), "has changed since the merge")
+
+	// There was no backend state before the merge
+	require.NoError(t, os.Remove(statePath))
+	r, err := latestRecord(wd)
+	require.NoError(t, err)
+	r.remove()
+	require.NoError(t, pushState(ctx, tf, nil, merged, 0, keys))
+	require.ErrorContains(t, undo(ctx, tfs, keys, 0), "there was no state in the backend")
+}
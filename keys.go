@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"local/tfmerge"
+
+	"filippo.io/age"
+	"github.com/urfave/cli/v2"
+)
+
+// ageKeys are the age identities decrypting the state files, and the recipients the written state files are encrypted to.
+// With recipients, no plaintext state is written to disk: the output and the backups are encrypted.
+type ageKeys struct {
+	identities []age.Identity
+	recipients []age.Recipient
+}
+
+// loadAgeKeys reads the --identity files and parses the --recipient flags
+func loadAgeKeys(ctx *cli.Context) (*ageKeys, error) {
+	var keys ageKeys
+	for _, path := range ctx.StringSlice("identity") {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading identity file: %v", err)
+		}
+		identities, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading identity file %s: %v", path, err)
+		}
+		keys.identities = append(keys.identities, identities...)
+	}
+	for _, v := range ctx.StringSlice("recipient") {
+		recipients, err := age.ParseRecipients(strings.NewReader(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --recipient %q: %v", v, err)
+		}
+		keys.recipients = append(keys.recipients, recipients...)
+	}
+	return &keys, nil
+}
+
+// checkWrites refuses to write the state to disk (i.e. --output, or the backup of --push) in plaintext when state files are
+// decrypted, as their plaintext would touch the disk. The written state files are encrypted if there is any recipient.
+func (keys *ageKeys) checkWrites(push bool, output string) error {
+	if len(keys.identities) == 0 || len(keys.recipients) != 0 {
+		return nil
+	}
+	switch {
+	case push:
+		return fmt.Errorf("--push backs up the base state in plaintext, use --recipient along with --identity to encrypt the backup")
+	case output != "":
+		return fmt.Errorf("--output writes the merged state in plaintext, use --recipient along with --identity to encrypt it")
+	}
+	return nil
+}
+
+// decode returns the plain JSON of a state file, which may be encrypted and/or compressed
+func (keys *ageKeys) decode(b []byte) ([]byte, error) {
+	b, err := tfmerge.Decrypt(b, keys.identities)
+	if err != nil {
+		return nil, err
+	}
+	return tfmerge.Decompress(b)
+}
+
+// encrypt encrypts the state file to the recipients, unless there is none or it's encrypted already
+func (keys *ageKeys) encrypt(b []byte) ([]byte, error) {
+	if tfmerge.IsEncrypted(b) {
+		return b, nil
+	}
+	return tfmerge.Encrypt(b, keys.recipients)
+}
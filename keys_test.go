@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgeKeysCheckWrites(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	identities := []age.Identity{identity}
+	recipients := []age.Recipient{identity.Recipient()}
+
+	cases := []struct {
+		name     string
+		keys     ageKeys
+		push     bool
+		output   string
+		hasError string
+	}{
+		{name: "no key", push: true, output: "out.tfstate"},
+		{name: "stdout", keys: ageKeys{identities: identities}},
+		{name: "push", keys: ageKeys{identities: identities}, push: true, hasError: "--push backs up the base state in plaintext"},
+		{name: "output", keys: ageKeys{identities: identities}, output: "out.tfstate", hasError: "--output writes the merged state in plaintext"},
+		{name: "encrypted", keys: ageKeys{identities: identities, recipients: recipients}, push: true, output: "out.tfstate"},
+		{name: "recipients only", keys: ageKeys{recipients: recipients}, push: true, output: "out.tfstate"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.keys.checkWrites(tt.push, tt.output)
+			if tt.hasError != "" {
+				require.ErrorContains(t, err, tt.hasError)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
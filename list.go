@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"local/tfmerge"
+
+	"github.com/urfave/cli/v2"
+)
+
+// listColumns are the columns of the table & csv formats of the list command
+var listColumns = []string{"ADDRESS", "STATE FILE", "PROVIDER", "EACH", "STATUS", "CONFLICTS WITH"}
+
+// listStateFiles is the list command: it lists the resource instances of the same inputs as the merge, on stdout.
+func listStateFiles(ctx *cli.Context) error {
+	format := ctx.String("format")
+	switch format {
+	case "table", "jsonl", "csv":
+	default:
+		return fmt.Errorf("unknown list format %q", format)
+	}
+	cwd, err := workingDir(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := loadAgeKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	tfs := &terraformSession{wd: cwd}
+	pulledState, stateFiles, err := mergeInputs(ctx, tfs, ctx.Duration("lock-timeout"))
+	if err != nil {
+		return err
+	}
+	defer closeStateFiles(stateFiles)
+	opts := tfmerge.Options{
+		DataSources: ctx.String("data-sources"),
+		Identities:  keys.identities,
+	}
+	listOpts := tfmerge.ListOptions{
+		Addresses:     ctx.StringSlice("address"),
+		ConflictsOnly: ctx.Bool("conflicts-only"),
+	}
+	entries, report, err := tfmerge.List(pulledState, opts, listOpts, stateFiles)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(os.Stderr, report)
+
+	row := func(e tfmerge.ListEntry) []string {
+		status := e.Status
+		if e.DeposedKey != "" {
+			status += " (" + e.DeposedKey + ")"
+		}
+		return []string{e.Address, e.StateFile, e.Provider, e.Each, status, strings.Join(e.ConflictsWith, " ")}
+	}
+	switch format {
+	case "jsonl":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		header := make([]string, 0, len(listColumns))
+		for _, c := range listColumns {
+			header = append(header, strings.ToLower(strings.ReplaceAll(c, " ", "_")))
+		}
+		w.Write(header)
+		for _, e := range entries {
+			w.Write(row(e))
+		}
+		w.Flush()
+		return w.Error()
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(listColumns, "\t"))
+		for _, e := range entries {
+			r := row(e)
+			for i, v := range r {
+				if v == "" {
+					r[i] = "-"
+				}
+			}
+			fmt.Fprintln(w, strings.Join(r, "\t"))
+		}
+		return w.Flush()
+	}
+	return nil
+}
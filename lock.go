@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ------------------| Lock: FNs |------------------
+// Terraform's local backend locks a state file in two ways, both are honored:
+//   - The lock info file next to it, i.e. .<name>.lock.info
+//   - An OS lock on the state file itself (fcntl on unix, LockFileEx on windows)
+
+// lockPollInterval is how often a locked state file is checked again while waiting for it
+var lockPollInterval = time.Second
+
+// lockInfo is the content of a lock info file, in the same format as terraform's
+type lockInfo struct {
+	ID        string
+	Operation string
+	Info      string
+	Who       string
+	Version   string
+	Created   time.Time
+	Path      string
+}
+
+func lockInfoPath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, "."+name+".lock.info")
+}
+
+// lockedError is returned for a state file locked by another process
+type lockedError struct {
+	path   string
+	info   *lockInfo // The lock info file, if any
+	holder string    // The holder of the OS lock, if any
+}
+
+func (e *lockedError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "state file %s is locked by another operation", e.path)
+	if e.holder != "" {
+		fmt.Fprintf(&b, " (%s)", e.holder)
+	}
+	if e.info == nil {
+		b.WriteString("\n")
+	} else {
+		b.WriteString(":\n")
+		fmt.Fprintf(&b, "  ID:        %s\n", e.info.ID)
+		fmt.Fprintf(&b, "  Path:      %s\n", e.info.Path)
+		fmt.Fprintf(&b, "  Operation: %s\n", e.info.Operation)
+		fmt.Fprintf(&b, "  Who:       %s\n", e.info.Who)
+		fmt.Fprintf(&b, "  Version:   %s\n", e.info.Version)
+		fmt.Fprintf(&b, "  Created:   %s\n", e.info.Created)
+		fmt.Fprintf(&b, "  Info:      %s\n", e.info.Info)
+	}
+	b.WriteString("use --lock-timeout to wait for the lock")
+	return b.String()
+}
+
+// checkLock returns a *lockedError if the state file is locked
+func checkLock(path string) error {
+	var info *lockInfo
+	b, err := os.ReadFile(lockInfoPath(path))
+	switch {
+	case err == nil:
+		info = &lockInfo{}
+		if err := json.Unmarshal(b, info); err != nil {
+			info = &lockInfo{Info: strings.TrimSpace(string(b))}
+		}
+	case !errors.Is(err, iofs.ErrNotExist):
+		return err
+	}
+	holder, locked, err := osLocked(path)
+	if err != nil {
+		return err
+	}
+	if info != nil || locked {
+		return &lockedError{path: path, info: info, holder: holder}
+	}
+	return nil
+}
+
+// waitUnlocked waits up to the timeout for all the state files to be unlocked.
+func waitUnlocked(ctx context.Context, timeout time.Duration, paths ...string) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var lockErr error
+		for _, path := range paths {
+			if err := checkLock(path); err != nil {
+				lockErr = err
+				break
+			}
+		}
+		var locked *lockedError
+		if lockErr == nil || !errors.As(lockErr, &locked) || !time.Now().Before(deadline) {
+			return lockErr
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// stateLock is the lock tfmerge holds on a state file, see lockStateFile.
+// NOTE: on POSIX, closing any descriptor of a file releases all the fcntl locks of the process on it,
+// so the locked state file is only read & written through the stateLock.
+type stateLock struct {
+	path     string
+	infoPath string
+	file     *os.File // The OS locked state file, nil if it doesn't exist (or isn't OS locked while writing)
+}
+
+// lockStateFile locks the state file the same way as terraform, once it's unlocked by others (waiting up to the timeout).
+func lockStateFile(ctx context.Context, path string, timeout time.Duration) (*stateLock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		lock, err := tryLockStateFile(path)
+		var locked *lockedError
+		if err == nil || !errors.As(err, &locked) || !time.Now().Before(deadline) {
+			return lock, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+func tryLockStateFile(path string) (*stateLock, error) {
+	if err := checkLock(path); err != nil {
+		return nil, err
+	}
+
+	info := newLockInfo(path)
+	b, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	lock := &stateLock{path: path, infoPath: lockInfoPath(path)}
+	f, err := os.OpenFile(lock.infoPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, iofs.ErrExist) {
+		// Someone else has just locked it
+		return nil, lockError(path, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("locking state file %s: %v", path, err)
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(lock.infoPath)
+		return nil, fmt.Errorf("locking state file %s: %v", path, err)
+	}
+
+	// The state file itself is OS locked as well, if it exists
+	if !osLockWhileWriting {
+		return lock, nil
+	}
+	state, err := os.OpenFile(path, os.O_RDWR, 0)
+	switch {
+	case err == nil:
+		if err := osLock(state); err != nil {
+			state.Close()
+			os.Remove(lock.infoPath)
+			return nil, lockError(path, err)
+		}
+		lock.file = state
+	case !errors.Is(err, iofs.ErrNotExist):
+		os.Remove(lock.infoPath)
+		return nil, err
+	}
+	return lock, nil
+}
+
+// read returns the content of the locked state file, nil if it doesn't exist
+func (lock *stateLock) read() ([]byte, error) {
+	if lock.file == nil {
+		b, err := os.ReadFile(lock.path)
+		if errors.Is(err, iofs.ErrNotExist) {
+			return nil, nil
+		}
+		return b, err
+	}
+	if _, err := lock.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(lock.file)
+}
+
+// write replaces the locked state file atomically (see writeStateFile).
+// The new state file is OS locked before it's renamed into place, so the lock keeps covering the state file on disk.
+func (lock *stateLock) write(b []byte) error {
+	if !osLockWhileWriting {
+		return writeStateFile(lock.path, b)
+	}
+	f, err := replaceStateFile(lock.path, b, true)
+	if err != nil {
+		return err
+	}
+	if lock.file != nil {
+		// The replaced file is gone, closing it only releases its own lock
+		osUnlock(lock.file)
+		lock.file.Close()
+	}
+	lock.file = f
+	return nil
+}
+
+// unlock releases the lock
+func (lock *stateLock) unlock() {
+	if lock.file != nil {
+		osUnlock(lock.file)
+		lock.file.Close()
+		lock.file = nil
+	}
+	os.Remove(lock.infoPath)
+}
+
+// lockError explains a failure to lock the state file, by the holder of the lock if it's still held
+func lockError(path string, err error) error {
+	if lerr := checkLock(path); lerr != nil {
+		return lerr
+	}
+	return fmt.Errorf("locking state file %s: %v", path, err)
+}
+
+func newLockInfo(path string) *lockInfo {
+	id := make([]byte, 16)
+	rand.Read(id)
+	who := "unknown"
+	if u, err := user.Current(); err == nil {
+		who = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		who += "@" + host
+	}
+	return &lockInfo{
+		ID:        fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]),
+		Operation: "tfmerge",
+		Who:       who,
+		Created:   time.Now().UTC(),
+		Path:      path,
+	}
+}
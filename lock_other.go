@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package main
+
+import "os"
+
+// The platform has no file locks, only the lock info files are honored
+
+const osLockWhileWriting = true
+
+func osLocked(path string) (string, bool, error) { return "", false, nil }
+
+func osLock(f *os.File) error { return nil }
+
+func osUnlock(f *os.File) error { return nil }
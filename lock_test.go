@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"local/tfmerge"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "terraform.tfstate")
+	require.NoError(t, checkLock(path), "no state file")
+	require.NoError(t, os.WriteFile(path, []byte("{}"), 0600))
+	require.NoError(t, checkLock(path), "no lock")
+
+	info, err := json.Marshal(&lockInfo{ID: "1234", Operation: "OperationTypeApply", Who: "me@host"})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(lockInfoPath(path), info, 0600))
+	err = checkLock(path)
+	var locked *lockedError
+	require.True(t, errors.As(err, &locked), "locked by the lock info file: %v", err)
+	require.Equal(t, "1234", locked.info.ID)
+	require.Contains(t, err.Error(), "OperationTypeApply")
+	require.Contains(t, err.Error(), "--lock-timeout")
+
+	// A lock info file of an unknown format still locks
+	require.NoError(t, os.WriteFile(lockInfoPath(path), []byte("locked by hand\n"), 0600))
+	err = checkLock(path)
+	require.True(t, errors.As(err, &locked))
+	require.Equal(t, "locked by hand", locked.info.Info)
+}
+
+func TestWaitUnlocked(t *testing.T) {
+	defer func(v time.Duration) { lockPollInterval = v }(lockPollInterval)
+	lockPollInterval = 10 * time.Millisecond
+
+	dir := t.TempDir()
+	unlocked, locked := filepath.Join(dir, "a.tfstate"), filepath.Join(dir, "b.tfstate")
+	require.NoError(t, os.WriteFile(lockInfoPath(locked), []byte("{}"), 0600))
+	ctx := context.Background()
+
+	require.NoError(t, waitUnlocked(ctx, 0, unlocked))
+	var lockErr *lockedError
+	err := waitUnlocked(ctx, 0, unlocked, locked)
+	require.True(t, errors.As(err, &lockErr), "no timeout: %v", err)
+	require.Equal(t, locked, lockErr.path)
+	err = waitUnlocked(ctx, 50*time.Millisecond, unlocked, locked)
+	require.True(t, errors.As(err, &lockErr), "timed out: %v", err)
+
+	// Unlocked while waiting
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.Remove(lockInfoPath(locked))
+	}()
+	require.NoError(t, waitUnlocked(ctx, 10*time.Second, unlocked, locked))
+
+	// Canceled while waiting
+	require.NoError(t, os.WriteFile(lockInfoPath(locked), []byte("{}"), 0600))
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, waitUnlocked(ctx, 10*time.Second, locked), context.DeadlineExceeded)
+}
+
+func TestLockStateFile(t *testing.T) {
+	defer func(v time.Duration) { lockPollInterval = v }(lockPollInterval)
+	lockPollInterval = 10 * time.Millisecond
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "terraform.tfstate")
+	require.NoError(t, os.WriteFile(path, []byte("v1"), 0640))
+	lock, err := lockStateFile(ctx, path, 0)
+	require.NoError(t, err)
+
+	// The lock info file is in the format of terraform
+	b, err := os.ReadFile(lockInfoPath(path))
+	require.NoError(t, err)
+	var info lockInfo
+	require.NoError(t, json.Unmarshal(b, &info))
+	require.Equal(t, "tfmerge", info.Operation)
+	require.Equal(t, path, info.Path)
+	require.NotEmpty(t, info.ID)
+
+	// Locked for others
+	var locked *lockedError
+	_, err = tryLockStateFile(path)
+	require.True(t, errors.As(err, &locked), "%v", err)
+	_, err = lockStateFile(ctx, path, 50*time.Millisecond)
+	require.True(t, errors.As(err, &locked), "%v", err)
+
+	// Read & written through the lock, the mode is kept
+	b, err = lock.read()
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(b))
+	require.NoError(t, lock.write([]byte("v2")))
+	b, err = lock.read()
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(b))
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(b))
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+	// Waits for the lock to be released
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		lock.unlock()
+	}()
+	lock2, err := lockStateFile(ctx, path, 10*time.Second)
+	require.NoError(t, err)
+	lock2.unlock()
+	_, err = os.Stat(lockInfoPath(path))
+	require.True(t, os.IsNotExist(err), "the lock info file is removed on unlock")
+
+	// A state file that doesn't exist yet
+	path = filepath.Join(dir, "new.tfstate")
+	lock, err = lockStateFile(ctx, path, 0)
+	require.NoError(t, err)
+	defer lock.unlock()
+	b, err = lock.read()
+	require.NoError(t, err)
+	require.Nil(t, b)
+	require.NoError(t, lock.write([]byte("v1")))
+	fi, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(defaultStateFileMode), fi.Mode().Perm())
+}
+
+func TestStateFilePaths(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "terraform.tfstate")
+	require.NoError(t, os.WriteFile(path, []byte("{}"), 0600))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Only the state files read from disk can be locked
+	require.Equal(t, []string{path}, stateFilePaths([]tfmerge.NamedReader{
+		{Name: "<stdin>", Reader: os.Stdin},
+		{Name: "workspace dev", Reader: f},
+		{Name: "workspace prod", Reader: strings.NewReader("{}")},
+	}))
+}
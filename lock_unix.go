@@ -0,0 +1,41 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"syscall"
+)
+
+const osLockWhileWriting = true
+
+// osLocked checks whether another process holds the fcntl lock terraform takes on the state file
+func osLocked(path string) (string, bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, iofs.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 0, Len: 0}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &lock); err != nil {
+		return "", false, fmt.Errorf("checking the lock of %s: %v", path, err)
+	}
+	if lock.Type == syscall.F_UNLCK {
+		return "", false, nil
+	}
+	return fmt.Sprintf("process %d", lock.Pid), true, nil
+}
+
+func osLock(f *os.File) error {
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 0, Len: 0})
+}
+
+func osUnlock(f *os.File) error {
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &syscall.Flock_t{Type: syscall.F_UNLCK, Whence: 0, Start: 0, Len: 0})
+}
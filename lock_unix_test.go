@@ -0,0 +1,107 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLockHelperProcess is run by lockHelper in another process, as the fcntl locks of a process don't conflict with its own
+func TestLockHelperProcess(t *testing.T) {
+	path := os.Getenv("TFMERGE_LOCK_HELPER_PATH")
+	if path == "" {
+		return
+	}
+	switch os.Getenv("TFMERGE_LOCK_HELPER") {
+	case "hold": // Hold the lock until stdin is closed
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err == nil {
+			err = osLock(f)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("locked")
+		io.Copy(io.Discard, os.Stdin)
+	case "check":
+		_, locked, err := osLocked(path)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(locked)
+	}
+	os.Exit(0)
+}
+
+func lockHelper(t *testing.T, mode, path string) (*exec.Cmd, io.WriteCloser, string) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelperProcess$")
+	cmd.Env = append(os.Environ(), "TFMERGE_LOCK_HELPER="+mode, "TFMERGE_LOCK_HELPER_PATH="+path)
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	return cmd, stdin, strings.TrimSpace(line)
+}
+
+// lockedByOthers checks the OS lock of the state file from another process
+func lockedByOthers(t *testing.T, path string) bool {
+	cmd, stdin, out := lockHelper(t, "check", path)
+	stdin.Close()
+	require.NoError(t, cmd.Wait())
+	require.Contains(t, []string{"true", "false"}, out)
+	return out == "true"
+}
+
+func TestOSLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "terraform.tfstate")
+	require.NoError(t, os.WriteFile(path, []byte("{}"), 0600))
+
+	// Locked by terraform, i.e. another process
+	cmd, stdin, out := lockHelper(t, "hold", path)
+	require.Equal(t, "locked", out)
+	err := checkLock(path)
+	var locked *lockedError
+	require.True(t, errors.As(err, &locked), "%v", err)
+	require.Equal(t, fmt.Sprintf("process %d", cmd.Process.Pid), locked.holder)
+	_, err = tryLockStateFile(path)
+	require.True(t, errors.As(err, &locked), "%v", err)
+	_, err = os.Stat(lockInfoPath(path))
+	require.True(t, os.IsNotExist(err), "no lock info file is left behind")
+	stdin.Close()
+	require.NoError(t, cmd.Wait())
+	require.NoError(t, checkLock(path))
+}
+
+func TestStateLockHoldsOSLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "terraform.tfstate")
+	require.NoError(t, os.WriteFile(path, []byte("v1"), 0600))
+
+	lock, err := lockStateFile(context.Background(), path, 0)
+	require.NoError(t, err)
+	require.True(t, lockedByOthers(t, path))
+	// Reading doesn't release the lock
+	_, err = lock.read()
+	require.NoError(t, err)
+	require.True(t, lockedByOthers(t, path))
+	// The state file written in place of the locked one is locked as well
+	require.NoError(t, lock.write([]byte("v2")))
+	require.True(t, lockedByOthers(t, path))
+	lock.unlock()
+	require.False(t, lockedByOthers(t, path))
+}
@@ -0,0 +1,64 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	iofs "io/fs"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// A file held open (for its lock) can't be replaced on windows, so the state file being written is only locked by its lock info file
+const osLockWhileWriting = false
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+)
+
+// osLocked checks whether another process holds the LockFileEx lock terraform takes on the state file
+func osLocked(path string) (string, bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, iofs.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	if err := lockFileEx(f, lockfileFailImmediately); err != nil {
+		return "", true, nil
+	}
+	osUnlock(f)
+	return "", false, nil
+}
+
+func osLock(f *os.File) error {
+	return lockFileEx(f, lockfileExclusiveLock|lockfileFailImmediately)
+}
+
+func osUnlock(f *os.File) error {
+	ol := new(syscall.Overlapped)
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func lockFileEx(f *os.File, flags uint32) error {
+	ol := new(syscall.Overlapped)
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
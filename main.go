@@ -7,6 +7,9 @@ import (
 	"local/tfmerge"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/go-version"
 	install "github.com/hashicorp/hc-install"
@@ -23,13 +26,19 @@ func main() {
 	app := &cli.App{
 		Name:      "tfmerge",
 		Usage:     `Merge Terraform state files into the state file of the current working directory`,
-		UsageText: "tfmerge [option] statefile ...",
+		UsageText: "tfmerge [option] statefile ... (\"-\" reads a statefile from stdin)",
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:    "output",
 				EnvVars: []string{"TFMERGE_OUTPUT"},
 				Aliases: []string{"o"},
-				Usage:   "The output merged state file name",
+				Usage:   "The output merged state file name, compressed if it ends with .gz or .zst",
+			},
+			&cli.StringFlag{
+				Name:    "output-format",
+				EnvVars: []string{"TFMERGE_OUTPUT_FORMAT"},
+				Value:   "state",
+				Usage:   "The format of the output: state (the merged state file), or show-json (the merged state as terraform show -json shows it). --push always pushes the state",
 			},
 			&cli.BoolFlag{
 				Name:    "debug",
@@ -48,46 +57,313 @@ func main() {
 				Aliases: []string{"resolveBy", "ic", "r"},
 				Usage:   "How to handle merge conflicts",
 			},
+			&cli.StringFlag{
+				Name:    "max-terraform-version",
+				EnvVars: []string{"TFMERGE_MAX_TERRAFORM_VERSION"},
+				Usage:   "Refuse state files written by a terraform newer than this version",
+			},
+			&cli.BoolFlag{
+				Name:    "strict-lineage",
+				EnvVars: []string{"TFMERGE_STRICT_LINEAGE"},
+				Usage:   "Error if multiple state files share the same lineage, instead of only merging the highest serial one",
+			},
+			&cli.StringFlag{
+				Name:    "duplicate-objects",
+				EnvVars: []string{"TFMERGE_DUPLICATE_OBJECTS"},
+				Value:   "error",
+				Usage:   "How to handle a real object managed by multiple addresses: error or warn",
+			},
+			&cli.StringSliceFlag{
+				Name:    "identity-attribute",
+				EnvVars: []string{"TFMERGE_IDENTITY_ATTRIBUTE"},
+				Usage:   "The attribute identifying the real object of a resource type, in the form of TYPE=ATTRIBUTE (default: id)",
+			},
+			&cli.StringFlag{
+				Name:    "data-sources",
+				EnvVars: []string{"TFMERGE_DATA_SOURCES"},
+				Value:   "dedupe",
+				Usage:   "How to handle data sources: keep (same as managed resources), drop, or dedupe (silently keep one copy of the conflicting ones)",
+			},
+			&cli.StringFlag{
+				Name:    "deposed",
+				EnvVars: []string{"TFMERGE_DEPOSED"},
+				Value:   "keep",
+				Usage:   "How to handle deposed objects: keep, drop, or error (refuse to merge state files containing them)",
+			},
+			&cli.StringSliceFlag{
+				Name:    "provider-map",
+				EnvVars: []string{"TFMERGE_PROVIDER_MAP"},
+				Usage:   `Remap the provider of the merged resources, in the form of FROM=TO. Both are either provider source addresses (e.g. registry.terraform.io/hashicorp/aws) or provider configurations (e.g. provider["registry.terraform.io/hashicorp/aws"].west)`,
+			},
+			&cli.StringFlag{
+				Name:    "base",
+				EnvVars: []string{"TFMERGE_BASE"},
+				Usage:   `Read the base state from this file ("-" for stdin), instead of pulling it from the working directory`,
+			},
+			&cli.StringSliceFlag{
+				Name:    "discover",
+				EnvVars: []string{"TFMERGE_DISCOVER"},
+				Usage:   "Merge the state files found in this directory tree as well, each under a module derived from its relative path",
+			},
+			&cli.StringSliceFlag{
+				Name:    "discover-glob",
+				EnvVars: []string{"TFMERGE_DISCOVER_GLOB"},
+				Usage:   "The file names to discover (default: *.tfstate, *.tfstate.gz & *.tfstate.zst)",
+			},
+			&cli.StringSliceFlag{
+				Name:    "discover-ignore",
+				EnvVars: []string{"TFMERGE_DISCOVER_IGNORE"},
+				Usage:   "Skip the discovered files & directories matching this glob, by name or by relative path",
+			},
+			&cli.BoolFlag{
+				Name:    "discover-backups",
+				EnvVars: []string{"TFMERGE_DISCOVER_BACKUPS"},
+				Usage:   "Also discover the *.backup files",
+			},
+			&cli.BoolFlag{
+				Name:    "discover-terraform-dir",
+				EnvVars: []string{"TFMERGE_DISCOVER_TERRAFORM_DIR"},
+				Usage:   "Also discover the state files in the .terraform directories",
+			},
+			&cli.BoolFlag{
+				Name:    "from-workspaces",
+				EnvVars: []string{"TFMERGE_FROM_WORKSPACES"},
+				Usage:   "Merge the states of all the workspaces of the working directory as well",
+			},
+			&cli.StringSliceFlag{
+				Name:    "workspace",
+				EnvVars: []string{"TFMERGE_WORKSPACE"},
+				Usage:   "Merge the state of this workspace of the working directory as well (implies --from-workspaces, limited to the named workspaces)",
+			},
+			&cli.BoolFlag{
+				Name:    "workspace-modules",
+				EnvVars: []string{"TFMERGE_WORKSPACE_MODULES"},
+				Usage:   "Put the state of each workspace under module.<workspace>",
+			},
+			&cli.BoolFlag{
+				Name:    "push",
+				EnvVars: []string{"TFMERGE_PUSH"},
+				Usage:   "Push the merged state to the backend of the working directory, after backing up the base state",
+			},
+			&cli.StringSliceFlag{
+				Name:    "identity",
+				EnvVars: []string{"TFMERGE_IDENTITY"},
+				Usage:   "Decrypt the age encrypted state files with the identities in this file, --output & --push need --recipient as well",
+			},
+			&cli.StringSliceFlag{
+				Name:    "recipient",
+				EnvVars: []string{"TFMERGE_RECIPIENT"},
+				Usage:   "Encrypt the merged state (and the backups) to this age recipient, e.g. age1...",
+			},
+			&cli.BoolFlag{
+				Name:    "redact",
+				EnvVars: []string{"TFMERGE_REDACT"},
+				Usage:   "Redact the secrets of the merged state, so it can be shared to debug the merge",
+			},
+			&cli.StringSliceFlag{
+				Name:    "redact-pattern",
+				EnvVars: []string{"TFMERGE_REDACT_PATTERN"},
+				Usage:   `Also redact the attributes matching this glob by their dotted path (e.g. "*password*"), besides the sensitive attributes & private data`,
+			},
+			&cli.StringFlag{
+				Name:    "redact-key",
+				EnvVars: []string{"TFMERGE_REDACT_KEY"},
+				Usage:   "The key of the hashes replacing the redacted values, to keep their equality across runs (random by default)",
+			},
+			&cli.DurationFlag{
+				Name:    "lock-timeout",
+				EnvVars: []string{"TFMERGE_LOCK_TIMEOUT"},
+				Usage:   "How long to wait for the locked state files (base state, state files & output) to be unlocked, e.g. 30s",
+			},
+			&cli.BoolFlag{
+				Name:    "no-base",
+				EnvVars: []string{"TFMERGE_NO_BASE"},
+				Usage:   "Merge the state files without any base state",
+			},
 		},
-		Action: func(ctx *cli.Context) error {
+		Before: func(ctx *cli.Context) error {
 			log.SetOutput(io.Discard)
 			if ctx.Bool("debug") {
 				log.SetPrefix("[tfmerge] ")
 				log.SetOutput(os.Stderr)
 			}
-			cwd, err := os.Getwd()
-			resolution := ""
+			return nil
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "redact",
+				Usage:     "Redact the secrets of state files, so they can be shared to debug a merge",
+				UsageText: "tfmerge [option] redact [--out-dir DIR] statefile ...",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "out-dir",
+						Usage: "Write the redacted state files to this directory, instead of stdout (needed for multiple state files)",
+					},
+				},
+				Action: redactStateFiles,
+			},
+			{
+				Name:      "convert",
+				Usage:     "Convert terraform show -json documents of states into state files",
+				UsageText: "tfmerge [option] convert [--out-dir DIR] show.json ...",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "out-dir",
+						Usage: "Write the state files to this directory (e.g. prod.json to DIR/prod.tfstate), instead of stdout (needed for multiple documents)",
+					},
+				},
+				Action: convertShowJSON,
+			},
+			{
+				Name:      "list",
+				Usage:     "List the resource instances of the state files to merge, with their state file, provider, each mode, status and conflicts",
+				UsageText: "tfmerge [option] list [--format table|jsonl|csv] [--address GLOB] [--conflicts-only] statefile ...",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "format",
+						Value: "table",
+						Usage: "The output format: table, jsonl (JSON Lines) or csv",
+					},
+					&cli.StringSliceFlag{
+						Name:  "address",
+						Usage: `Only list the resource instances whose resource or instance address matches this glob, in the same syntax as --discover-glob & --redact-pattern (e.g. "module.network.*", or "aws_instance.web\[0\]" as brackets are character classes)`,
+					},
+					&cli.BoolFlag{
+						Name:  "conflicts-only",
+						Usage: "Only list the instances of the resources defined in more than one state file, which the merge refuses with the default --ifConflict",
+					},
+				},
+				Action: listStateFiles,
+			},
+			{
+				Name:  "undo",
+				Usage: "Restore the state replaced by the most recent write or push of a merged state, if it hasn't changed since",
+				Action: func(ctx *cli.Context) error {
+					cwd, err := workingDir(ctx)
+					if err != nil {
+						return err
+					}
+					keys, err := loadAgeKeys(ctx)
+					if err != nil {
+						return err
+					}
+					return undo(ctx.Context, &terraformSession{wd: cwd}, keys, ctx.Duration("lock-timeout"))
+				},
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			var opts tfmerge.Options
+			cwd, err := workingDir(ctx)
 			if err != nil {
 				return err
 			}
 
-			if v := ctx.String("chdir"); v != "" {
-				cwd = v
+			if v := ctx.String("ifConflict"); v != "" {
+				opts.Resolution = v
 			}
 
-			if v := ctx.String("ifConflict"); v != "" {
-				resolution = v
+			if v := ctx.String("max-terraform-version"); v != "" {
+				if _, err := version.NewVersion(v); err != nil {
+					return fmt.Errorf("invalid --max-terraform-version %q: %v", v, err)
+				}
+				opts.MaxTerraformVersion = v
+			}
+
+			opts.StrictLineage = ctx.Bool("strict-lineage")
+			opts.DuplicateObjects = ctx.String("duplicate-objects")
+			opts.DataSources = ctx.String("data-sources")
+			opts.Deposed = ctx.String("deposed")
+
+			for _, v := range ctx.StringSlice("identity-attribute") {
+				typ, attr, ok := strings.Cut(v, "=")
+				if !ok || typ == "" || attr == "" {
+					return fmt.Errorf("invalid --identity-attribute %q, expect TYPE=ATTRIBUTE", v)
+				}
+				if opts.IdentityAttributes == nil {
+					opts.IdentityAttributes = make(map[string]string)
+				}
+				opts.IdentityAttributes[typ] = attr
+			}
+
+			for _, v := range ctx.StringSlice("provider-map") {
+				from, to, ok := strings.Cut(v, "=")
+				if !ok || from == "" || to == "" {
+					return fmt.Errorf("invalid --provider-map %q, expect FROM=TO", v)
+				}
+				if opts.ProviderMap == nil {
+					opts.ProviderMap = make(map[string]string)
+				}
+				opts.ProviderMap[from] = to
+			}
+
+			switch ctx.String("output-format") {
+			case "state", "show-json":
+			default:
+				return fmt.Errorf("unknown output format %q", ctx.String("output-format"))
+			}
+			if ctx.Bool("push") && ctx.Bool("redact") {
+				return fmt.Errorf("--push can't be used with --redact, a redacted state is only for sharing")
+			}
+			if ctx.Bool("push") && (ctx.IsSet("base") || ctx.Bool("no-base")) {
+				return fmt.Errorf("--push needs the base state pulled from the working directory, it can't be used with --base or --no-base")
 			}
 
-			tf, err := initTerraform(context.Background(), cwd)
+			keys, err := loadAgeKeys(ctx)
 			if err != nil {
 				return err
 			}
+			if err := keys.checkWrites(ctx.Bool("push"), ctx.String("output")); err != nil {
+				return err
+			}
+			opts.Identities = keys.identities
 
-			pulledState, err := tf.StatePull(ctx.Context)
+			tfs := &terraformSession{wd: cwd}
+			lockTimeout := ctx.Duration("lock-timeout")
+			pulledState, stateFiles, err := mergeInputs(ctx, tfs, lockTimeout)
 			if err != nil {
-				return fmt.Errorf("pulling state file of the working directory: %v", err)
+				return err
 			}
+			defer closeStateFiles(stateFiles)
 
-			b, err := tfmerge.Merge(ctx.Context, tf, []byte(pulledState), resolution, ctx.Args().Slice()...)
+			b, report, err := tfmerge.MergeReaders(ctx.Context, pulledState, opts, stateFiles)
 			if err != nil {
 				return err
 			}
+			fmt.Fprint(os.Stderr, report)
 
+			if ctx.Bool("redact") {
+				redactor, err := newRedactor(ctx)
+				if err != nil {
+					return err
+				}
+				if b, err = redactor.Redact(b); err != nil {
+					return fmt.Errorf("redacting the merged state: %v", err)
+				}
+			}
+			if ctx.Bool("push") {
+				tf, err := tfs.get(ctx.Context)
+				if err != nil {
+					return err
+				}
+				if err := pushState(ctx.Context, tf, pulledState, b, lockTimeout, keys); err != nil {
+					return err
+				}
+				if ctx.String("output") == "" {
+					return nil
+				}
+			}
+			if ctx.String("output-format") == "show-json" {
+				if b, err = tfmerge.ShowJSON(b); err != nil {
+					return fmt.Errorf("showing the merged state: %v", err)
+				}
+			}
 			if v := ctx.String("output"); v != "" {
-				return os.WriteFile(v, b, 0644)
+				return writeOutput(ctx.Context, cwd, v, b, lockTimeout, keys)
 			}
-			fmt.Println(string(b))
+			if b, err = keys.encrypt(b); err != nil {
+				return err
+			}
+			fmt.Print(string(b))
 			return nil
 		},
 	}
@@ -98,6 +374,222 @@ func main() {
 	}
 }
 
+// workingDir is the working directory of terraform & the .tfmerge history
+func workingDir(ctx *cli.Context) (string, error) {
+	if v := ctx.String("chdir"); v != "" {
+		return v, nil
+	}
+	return os.Getwd()
+}
+
+// writeOutput writes the merged state to the output file, the previous output file is recorded in the history.
+// The output file is locked while it's written, compressed as its name asks for, then encrypted to the age recipients.
+func writeOutput(ctx context.Context, cwd, path string, b []byte, lockTimeout time.Duration, keys *ageKeys) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	lock, err := lockStateFile(ctx, abs, lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	previous, err := lock.read()
+	if err != nil {
+		return err
+	}
+	out, err := tfmerge.CompressFor(abs, b)
+	if err != nil {
+		return fmt.Errorf("compressing the output: %v", err)
+	}
+	if out, err = keys.encrypt(out); err != nil {
+		return fmt.Errorf("encrypting the output: %v", err)
+	}
+	r, err := recordHistory(cwd, abs, previous, b, keys)
+	if err != nil {
+		return err
+	}
+	if err := lock.write(out); err != nil {
+		r.remove()
+		return err
+	}
+	return nil
+}
+
+// baseState returns the base state to merge into: read from --base, none for --no-base, otherwise pulled from the working directory.
+// Terraform is only needed in the last case.
+// The base state is read once it's unlocked, i.e. no other terraform command is running on a local backend.
+func baseState(ctx *cli.Context, tfs *terraformSession, lockTimeout time.Duration) ([]byte, error) {
+	if ctx.IsSet("base") && ctx.Bool("no-base") {
+		return nil, fmt.Errorf("--base and --no-base are mutually exclusive")
+	}
+	if v := ctx.String("base"); v == "-" {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("reading the base state from stdin: %v", err)
+		}
+		return b, nil
+	} else if v != "" {
+		if err := waitUnlocked(ctx.Context, lockTimeout, v); err != nil {
+			return nil, err
+		}
+		b, err := os.ReadFile(v)
+		if err != nil {
+			return nil, fmt.Errorf("reading the base state: %v", err)
+		}
+		return b, nil
+	}
+	if ctx.Bool("no-base") {
+		return nil, nil
+	}
+
+	path, err := tfmerge.LocalStatePath(tfs.wd)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		if err := waitUnlocked(ctx.Context, lockTimeout, path); err != nil {
+			return nil, err
+		}
+	}
+	tf, err := tfs.get(ctx.Context)
+	if err != nil {
+		return nil, err
+	}
+	pulledState, err := tf.StatePull(ctx.Context)
+	if err != nil {
+		return nil, fmt.Errorf("pulling state file of the working directory: %v", err)
+	}
+	return []byte(pulledState), nil
+}
+
+// openStateFiles opens the state files to merge, "-" reads the state file from stdin (only once).
+func openStateFiles(paths []string, stdinUsed bool) ([]tfmerge.NamedReader, error) {
+	var stateFiles []tfmerge.NamedReader
+	for _, path := range paths {
+		if path == "-" {
+			if stdinUsed {
+				return nil, fmt.Errorf("stdin can only be read once")
+			}
+			stdinUsed = true
+			stateFiles = append(stateFiles, tfmerge.NamedReader{Name: "<stdin>", Reader: os.Stdin})
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			closeStateFiles(stateFiles)
+			return nil, err
+		}
+		stateFiles = append(stateFiles, tfmerge.NamedReader{Name: path, Reader: f})
+	}
+	return stateFiles, nil
+}
+
+// mergeInputs returns the base state and the state files to merge: the arguments, the discovered state files and
+// the workspaces, once they are unlocked. The state files are to be closed by closeStateFiles.
+func mergeInputs(ctx *cli.Context, tfs *terraformSession, lockTimeout time.Duration) ([]byte, []tfmerge.NamedReader, error) {
+	stateFiles, err := openStateFiles(ctx.Args().Slice(), ctx.String("base") == "-")
+	if err != nil {
+		return nil, nil, err
+	}
+	discovered, err := discoverStateFiles(ctx)
+	if err != nil {
+		closeStateFiles(stateFiles)
+		return nil, nil, err
+	}
+	stateFiles = append(stateFiles, discovered...)
+
+	// The workspace states of a local backend are opened from disk, they're read once unlocked like the other state files
+	if ctx.Bool("from-workspaces") || ctx.IsSet("workspace") {
+		tf, err := tfs.get(ctx.Context)
+		if err != nil {
+			closeStateFiles(stateFiles)
+			return nil, nil, err
+		}
+		workspaces, err := tfmerge.WorkspaceStates(ctx.Context, tf, ctx.StringSlice("workspace"), ctx.Bool("workspace-modules"))
+		if err != nil {
+			closeStateFiles(stateFiles)
+			return nil, nil, err
+		}
+		stateFiles = append(stateFiles, workspaces...)
+	}
+	if err := waitUnlocked(ctx.Context, lockTimeout, stateFilePaths(stateFiles)...); err != nil {
+		closeStateFiles(stateFiles)
+		return nil, nil, err
+	}
+
+	pulledState, err := baseState(ctx, tfs, lockTimeout)
+	if err != nil {
+		closeStateFiles(stateFiles)
+		return nil, nil, err
+	}
+	return pulledState, stateFiles, nil
+}
+
+// stateFilePaths returns the paths of the state files read from disk
+func stateFilePaths(stateFiles []tfmerge.NamedReader) []string {
+	var paths []string
+	for _, sf := range stateFiles {
+		if f, ok := sf.Reader.(*os.File); ok && f != os.Stdin {
+			paths = append(paths, f.Name())
+		}
+	}
+	return paths
+}
+
+// discoverStateFiles opens the state files found in the --discover directories
+func discoverStateFiles(ctx *cli.Context) ([]tfmerge.NamedReader, error) {
+	opts := tfmerge.DiscoverOptions{
+		Globs:        ctx.StringSlice("discover-glob"),
+		Ignore:       ctx.StringSlice("discover-ignore"),
+		Backups:      ctx.Bool("discover-backups"),
+		TerraformDir: ctx.Bool("discover-terraform-dir"),
+	}
+	var stateFiles []tfmerge.NamedReader
+	for _, dir := range ctx.StringSlice("discover") {
+		files, err := tfmerge.Discover(dir, opts)
+		if err != nil {
+			closeStateFiles(stateFiles)
+			return nil, err
+		}
+		for _, file := range files {
+			f, err := os.Open(file.Path)
+			if err != nil {
+				closeStateFiles(stateFiles)
+				return nil, err
+			}
+			stateFiles = append(stateFiles, tfmerge.NamedReader{Name: file.Path, Reader: f, Module: file.Module})
+		}
+	}
+	return stateFiles, nil
+}
+
+// closeStateFiles closes the state files opened from disk, stdin and the in-memory ones (e.g. of the workspaces) are left as is
+func closeStateFiles(stateFiles []tfmerge.NamedReader) {
+	for _, f := range stateFiles {
+		if c, ok := f.Reader.(io.Closer); ok && f.Reader != os.Stdin {
+			c.Close()
+		}
+	}
+}
+
+// terraformSession initializes terraform in the working directory on first use, so terraform is only required when needed
+type terraformSession struct {
+	wd string
+	tf *tfexec.Terraform
+}
+
+func (tfs *terraformSession) get(ctx context.Context) (*tfexec.Terraform, error) {
+	if tfs.tf == nil {
+		tf, err := initTerraform(ctx, tfs.wd)
+		if err != nil {
+			return nil, err
+		}
+		tfs.tf = tf
+	}
+	return tfs.tf, nil
+}
+
 func initTerraform(ctx context.Context, tfwd string) (*tfexec.Terraform, error) {
 	i := install.NewInstaller()
 	tfpath, err := i.Ensure(ctx, []src.Source{
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+)
+
+// pushState backs up the base state pulled from the working directory, then pushes the merged state to its backend.
+// The backup is removed if the push fails, as the backend state is left unchanged.
+func pushState(ctx context.Context, tf *tfexec.Terraform, pulledState, mergedState []byte, lockTimeout time.Duration, keys *ageKeys) error {
+	r, err := recordHistory(tf.WorkingDir(), backendTarget, pulledState, mergedState, keys)
+	if err != nil {
+		return err
+	}
+	if err := pushFile(ctx, tf, mergedState, lockTimeout, keys); err != nil {
+		r.remove()
+		return err
+	}
+	if len(pulledState) != 0 {
+		fmt.Fprintf(os.Stderr, "The base state is backed up to %s\n", r.backupPath())
+	}
+	return nil
+}
+
+// pushFile pushes the state to the backend of the working directory.
+// The push holds the state lock, like any other terraform command writing the state.
+// With any age key, the state is pushed through stdin, as it might be decrypted from an encrypted one.
+func pushFile(ctx context.Context, tf *tfexec.Terraform, state []byte, lockTimeout time.Duration, keys *ageKeys) error {
+	if len(keys.recipients) != 0 || len(keys.identities) != 0 {
+		return pushStdin(ctx, tf, state, lockTimeout)
+	}
+
+	// terraform reads the state to push from a file
+	f, err := os.CreateTemp("", "tfmerge-*.tfstate")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(state); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := tf.StatePush(ctx, f.Name(), tfexec.Lock(true), tfexec.LockTimeout(lockTimeout.String())); err != nil {
+		return pushError(err)
+	}
+	return nil
+}
+
+// pushStdin pushes the state through the stdin of terraform, so the plaintext state never touches the disk.
+// NOTE: tfexec doesn't support stdin for `terraform state push`, so terraform is run directly.
+func pushStdin(ctx context.Context, tf *tfexec.Terraform, state []byte, lockTimeout time.Duration) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, tf.ExecPath(), "state", "push", "-lock=true", "-lock-timeout="+lockTimeout.String(), "-")
+	cmd.Dir = tf.WorkingDir()
+	cmd.Env = append(os.Environ(), "TF_IN_AUTOMATION=1", "CHECKPOINT_DISABLE=1")
+	cmd.Stdin = bytes.NewReader(state)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return pushError(fmt.Errorf("%v\n%s", err, strings.TrimSpace(stderr.String())))
+	}
+	return nil
+}
+
+// pushError explains why the backend refused the merged state
+func pushError(err error) error {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "lineage"):
+		return fmt.Errorf("pushing the merged state: the backend state has a different lineage than the base state, make sure the base state is pulled from the same working directory and workspace: %v", err)
+	case strings.Contains(msg, "serial"):
+		return fmt.Errorf("pushing the merged state: the backend state has changed since the base state was pulled, run tfmerge again to merge into the latest state: %v", err)
+	case strings.Contains(msg, "state lock"):
+		return fmt.Errorf("pushing the merged state: the state is locked by another operation, retry once it's done or use --lock-timeout to wait for it: %v", err)
+	}
+	return fmt.Errorf("pushing the merged state: %v", err)
+}
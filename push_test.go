@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushError(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    string
+		expect string
+	}{
+		{
+			name:   "lineage",
+			err:    "Error: Failed to write state: cannot import a state with lineage \"bbbb\" over unrelated state with lineage \"aaaa\"",
+			expect: "the backend state has a different lineage than the base state",
+		},
+		{
+			name:   "serial",
+			err:    "Error: Failed to write state: cannot import a state with serial 2 over a newer state with serial 3",
+			expect: "the backend state has changed since the base state was pulled",
+		},
+		{
+			name:   "lock",
+			err:    "Error: Error acquiring the state lock",
+			expect: "the state is locked by another operation",
+		},
+		{
+			name:   "other",
+			err:    "exit status 1",
+			expect: "pushing the merged state: exit status 1",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := pushError(errors.New(tt.err))
+			require.ErrorContains(t, err, tt.expect)
+			// The error of terraform is kept
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
@@ -0,0 +1,98 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/hashicorp/terraform-exec/tfexec"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTerraformScript pulls & pushes the state of a fake backend, i.e. the backend.tfstate file next to it.
+// The pushes fail with the content of the fail file if it exists, the arguments of each push are logged to pushes.log.
+const fakeTerraformScript = `#!/bin/sh
+dir=$(dirname "$0")
+case "$1 $2" in
+"state pull")
+	[ ! -f "$dir/backend.tfstate" ] || cat "$dir/backend.tfstate" ;;
+"state push")
+	echo "$@" >> "$dir/pushes.log"
+	if [ -f "$dir/fail" ]; then cat "$dir/fail" >&2; exit 1; fi
+	for state; do :; done
+	if [ "$state" = - ]; then cat > "$dir/backend.tfstate"; else cp "$state" "$dir/backend.tfstate"; fi ;;
+*)
+	exit 1 ;;
+esac
+`
+
+// fakeTerraform returns a terraform of the working directory wd with a fake backend, and the directory of the backend
+func fakeTerraform(t *testing.T, wd string) (*tfexec.Terraform, string) {
+	dir := t.TempDir()
+	execPath := filepath.Join(dir, "terraform")
+	require.NoError(t, os.WriteFile(execPath, []byte(fakeTerraformScript), 0700))
+	tf, err := tfexec.NewTerraform(wd, execPath)
+	require.NoError(t, err)
+	return tf, dir
+}
+
+func TestPushState(t *testing.T) {
+	wd := t.TempDir()
+	tf, backend := fakeTerraform(t, wd)
+	ctx := context.Background()
+	pulled := []byte(`{"version": 4, "serial": 1, "lineage": "aaaa"}`)
+	merged := []byte(`{"version": 4, "serial": 2, "lineage": "aaaa"}`)
+
+	// The failed push isn't recorded, so it doesn't block undo
+	require.NoError(t, os.WriteFile(filepath.Join(backend, "fail"), []byte("Error: Failed to write state: cannot import a state with serial 2 over a newer state with serial 3"), 0600))
+	err := pushState(ctx, tf, pulled, merged, 0, &ageKeys{})
+	require.ErrorContains(t, err, "the backend state has changed since the base state was pulled")
+	_, err = latestRecord(wd)
+	require.ErrorContains(t, err, "nothing to undo")
+	entries, err := os.ReadDir(filepath.Join(wd, historyDir))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	require.NoError(t, os.Remove(filepath.Join(backend, "fail")))
+	require.NoError(t, pushState(ctx, tf, pulled, merged, 0, &ageKeys{}))
+	b, err := os.ReadFile(filepath.Join(backend, "backend.tfstate"))
+	require.NoError(t, err)
+	require.Equal(t, merged, b)
+	r, err := latestRecord(wd)
+	require.NoError(t, err)
+	require.Equal(t, stateVersion{Serial: 2, Lineage: "aaaa"}, r.Merged)
+	log, err := os.ReadFile(filepath.Join(backend, "pushes.log"))
+	require.NoError(t, err)
+	require.Len(t, strings.Split(strings.TrimSpace(string(log)), "\n"), 2)
+}
+
+func TestPushFileStdin(t *testing.T) {
+	tf, backend := fakeTerraform(t, t.TempDir())
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	state := []byte(`{"version": 4, "serial": 2, "lineage": "aaaa"}`)
+
+	// The state is only written to a temporary file without any age key
+	for _, keys := range []*ageKeys{
+		{},
+		{identities: []age.Identity{identity}},
+		{recipients: []age.Recipient{identity.Recipient()}},
+	} {
+		require.NoError(t, pushFile(context.Background(), tf, state, 0, keys))
+		b, err := os.ReadFile(filepath.Join(backend, "backend.tfstate"))
+		require.NoError(t, err)
+		require.Equal(t, state, b)
+	}
+	log, err := os.ReadFile(filepath.Join(backend, "pushes.log"))
+	require.NoError(t, err)
+	pushes := strings.Split(strings.TrimSpace(string(log)), "\n")
+	require.Len(t, pushes, 3)
+	require.False(t, strings.HasSuffix(pushes[0], " -"), pushes[0])
+	require.True(t, strings.HasSuffix(pushes[1], " -"), pushes[1])
+	require.True(t, strings.HasSuffix(pushes[2], " -"), pushes[2])
+}
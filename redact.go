@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+
+	"local/tfmerge"
+
+	"github.com/urfave/cli/v2"
+)
+
+func newRedactor(ctx *cli.Context) (*tfmerge.Redactor, error) {
+	return tfmerge.NewRedactor(tfmerge.RedactOptions{
+		Patterns: ctx.StringSlice("redact-pattern"),
+		Key:      []byte(ctx.String("redact-key")),
+	})
+}
+
+// redactStateFiles is the redact command: all the state files are redacted with the same key, so they keep the equality of their values.
+func redactStateFiles(ctx *cli.Context) error {
+	redactor, err := newRedactor(ctx)
+	if err != nil {
+		return err
+	}
+	return transformStateFiles(ctx, "stdin.tfstate", func(path string, b []byte) ([]byte, string, error) {
+		b, err := redactor.Redact(b)
+		if err != nil {
+			return nil, "", fmt.Errorf("redacting state file %s: %v", path, err)
+		}
+		return b, path, nil
+	})
+}
@@ -0,0 +1,177 @@
+package tfmerge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// ---------------|CANONICAL FORMAT|---------------
+// The merged state is written in the same layout as terraform writes state files:
+//   - Two spaces indentation, with a trailing newline
+//   - The fields in the order of terraform's state file (format version 4)
+//   - Resources sorted by module, mode, type and name, instances sorted by index key (then deposed key)
+//
+// So the same inputs always produce byte-identical output, and diffs of the state files are readable.
+
+// The order terraform writes the fields of an instance and an output, the unknown fields go last (sorted by name)
+var (
+	instanceFieldOrder = []string{
+		"index_key", "status", "deposed",
+		"schema_version", "attributes", "attributes_flat", "sensitive_attributes",
+		"identity_schema_version", "identity",
+		"private", "dependencies", "create_before_destroy",
+	}
+	outputFieldOrder = []string{"value", "type", "sensitive"}
+)
+
+// marshalState marshals the state in the canonical format
+func marshalState(state *State) ([]byte, error) {
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// SetSerial returns the state with its serial replaced, e.g. to push an older snapshot of a state to its backend again.
+// The state is written in the canonical format, the rest of its content is kept.
+func SetSerial(b []byte, serial int) ([]byte, error) {
+	var state State
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	if state.Version != 4 {
+		return nil, fmt.Errorf("unsupported state format version %d", state.Version)
+	}
+	state.Serial = serial
+	return marshalState(&state)
+}
+
+type orderedField struct {
+	key   string
+	value interface{}
+}
+
+// orderedObject is a JSON object whose fields are marshalled in order
+type orderedObject []orderedField
+
+func (obj orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range obj {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		kb, err := json.Marshal(field.key)
+		if err != nil {
+			return nil, err
+		}
+		vb, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(kb)
+		buf.WriteByte(':')
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// orderFields returns the fields of the decoded JSON object in the given order, followed by the other fields sorted by name.
+// Values that are not objects are returned as is.
+func orderFields(v interface{}, order []string) interface{} {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+	ordered := make(orderedObject, 0, len(obj))
+	known := make(map[string]bool)
+	for _, k := range order {
+		known[k] = true
+		if v, ok := obj[k]; ok {
+			ordered = append(ordered, orderedField{key: k, value: v})
+		}
+	}
+	var rest []string
+	for k := range obj {
+		if !known[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	for _, k := range rest {
+		ordered = append(ordered, orderedField{key: k, value: obj[k]})
+	}
+	return ordered
+}
+
+// canonicalState turns the decoded (v4) state file into a State, with its resources in the order terraform writes them
+func canonicalState(thisState map[string]interface{}) (*State, error) {
+	b, err := json.Marshal(thisState)
+	if err != nil {
+		return nil, err
+	}
+	var state State
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	state.sortResources()
+	return &state, nil
+}
+
+// sortResources sorts the resources and their instances in the order terraform writes them
+func (state *State) sortResources() {
+	sort.SliceStable(state.Resources, func(i, j int) bool {
+		ri, rj := state.Resources[i], state.Resources[j]
+		if ri.Module != rj.Module {
+			return ri.Module < rj.Module
+		}
+		if ri.Mode != rj.Mode {
+			return ri.Mode < rj.Mode
+		}
+		if ri.Type != rj.Type {
+			return ri.Type < rj.Type
+		}
+		return ri.Name < rj.Name
+	})
+	for _, res := range state.Resources {
+		instances := res.Instances
+		sort.SliceStable(instances, func(i, j int) bool {
+			ii, _ := instances[i].(map[string]interface{})
+			ij, _ := instances[j].(map[string]interface{})
+			ki, kj := keyOf(ii), keyOf(ij)
+			if ki.index != kj.index {
+				return indexKeyLess(ki.index, kj.index)
+			}
+			return ki.deposed < kj.deposed
+		})
+	}
+}
+
+// indexKeyLess orders no key first, then the numeric keys, then the string keys
+func indexKeyLess(i, j interface{}) bool {
+	rank := func(k interface{}) int {
+		switch k.(type) {
+		case nil:
+			return 0
+		case float64:
+			return 1
+		default:
+			return 2
+		}
+	}
+	if rank(i) != rank(j) {
+		return rank(i) < rank(j)
+	}
+	switch i := i.(type) {
+	case float64:
+		return i < j.(float64)
+	case string:
+		js, _ := j.(string)
+		return i < js
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package tfmerge
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The state files in testdata are written by terraform, so they are in the canonical format already
+func TestMarshalStateCanonical(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*", "state*"))
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			b, err := os.ReadFile(path)
+			require.NoError(t, err)
+			var state State
+			require.NoError(t, json.Unmarshal(b, &state))
+			out, err := marshalState(&state)
+			require.NoError(t, err)
+			require.Equal(t, string(b), string(out))
+		})
+	}
+}
+
+func TestSortResources(t *testing.T) {
+	resource := func(module, mode, typ, name string, keys ...interface{}) Resource {
+		res := Resource{Module: module, Mode: mode, Type: typ, Name: name, Provider: `provider["registry.terraform.io/hashicorp/null"]`}
+		for _, k := range keys {
+			res.Instances = append(res.Instances, map[string]interface{}{"index_key": k, "schema_version": float64(0)})
+		}
+		return res
+	}
+	state := func(resources ...Resource) *State {
+		return &State{Version: 4, Serial: 1, Resources: resources}
+	}
+
+	a := resource("", "managed", "null_resource", "b", float64(10), float64(2), "x")
+	b := resource("", "managed", "null_resource", "a")
+	c := resource("", "data", "null_data_source", "a")
+	d := resource("module.m", "managed", "null_resource", "a", "y", "b")
+
+	s1 := state(a, b, c, d)
+	s1.sortResources()
+	out1, err := marshalState(s1)
+	require.NoError(t, err)
+
+	s2 := state(d, c, b, resource("", "managed", "null_resource", "b", "x", float64(2), float64(10)))
+	s2.sortResources()
+	out2, err := marshalState(s2)
+	require.NoError(t, err)
+	require.Equal(t, string(out1), string(out2))
+
+	var names []string
+	for _, res := range s1.Resources {
+		names = append(names, resourceAddr(res.Module, res.Mode, res.Type, res.Name))
+	}
+	require.Equal(t, []string{"data.null_data_source.a", "null_resource.a", "null_resource.b", "module.m.null_resource.a"}, names)
+	require.Equal(t, []interface{}{float64(2), float64(10), "x"}, []interface{}{
+		s1.Resources[2].Instances[0].(map[string]interface{})["index_key"],
+		s1.Resources[2].Instances[1].(map[string]interface{})["index_key"],
+		s1.Resources[2].Instances[2].(map[string]interface{})["index_key"],
+	})
+}
+
+func TestSetSerial(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "unknown_fields", "state1"))
+	require.NoError(t, err)
+	out, err := SetSerial(b, 42)
+	require.NoError(t, err)
+
+	var expect, actual map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &expect))
+	require.NoError(t, json.Unmarshal(out, &actual))
+	expect["serial"] = float64(42)
+	require.Equal(t, expect, actual)
+
+	_, err = SetSerial([]byte(`{"version": 3, "serial": 1}`), 2)
+	require.Error(t, err)
+}
@@ -61,6 +61,10 @@ var cases = []struct {
 		name: "Module instance",
 		dir:  "module_instance",
 	},
+	{
+		name: "Unknown fields",
+		dir:  "unknown_fields",
+	},
 	{
 		name:     "Resource conflict",
 		dir:      "resource_conflict",
@@ -0,0 +1,86 @@
+package tfmerge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ------------------| Compression: FNs |------------------
+// Compressed state files (e.g. archived as .tfstate.gz or .tfstate.zst) are detected by their magic bytes, whatever their name.
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressionExts are the file extensions asking for a compressed state file
+var compressionExts = []string{".gz", ".zst"}
+
+// Decompress decompresses a gzip or zstd compressed state file, other content is returned as is.
+func Decompress(b []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(b, gzipMagic):
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing gzip: %v", err)
+		}
+		defer r.Close()
+		out, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing gzip: %v", err)
+		}
+		return out, nil
+	case bytes.HasPrefix(b, zstdMagic):
+		r, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		out, err := r.DecodeAll(b, nil)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing zstd: %v", err)
+		}
+		return out, nil
+	}
+	return b, nil
+}
+
+// CompressFor compresses the state file as its file name asks for: gzip for .gz, zstd for .zst, as is otherwise.
+func CompressFor(path string, b []byte) ([]byte, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz":
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case ".zst":
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		return w.EncodeAll(b, nil), nil
+	}
+	return b, nil
+}
+
+// trimCompressionExt trims the extension of a compressed file name, e.g. "terraform.tfstate.gz" to "terraform.tfstate"
+func trimCompressionExt(name string) string {
+	for _, ext := range compressionExts {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
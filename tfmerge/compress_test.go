@@ -0,0 +1,48 @@
+package tfmerge
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	state := []byte(`{"version": 4, "serial": 1}`)
+	for _, name := range []string{"out.tfstate.gz", "out.tfstate.zst", "out.tfstate"} {
+		t.Run(name, func(t *testing.T) {
+			b, err := CompressFor(name, state)
+			require.NoError(t, err)
+			if filepath.Ext(name) != ".tfstate" {
+				require.NotEqual(t, state, b)
+			}
+			out, err := Decompress(b)
+			require.NoError(t, err)
+			require.Equal(t, state, out)
+		})
+	}
+}
+
+func TestMergeCompressed(t *testing.T) {
+	initTest(t)
+	stateFiles, _ := testFixture(t, "resource_only")
+	expect, err := Merge(context.Background(), nil, Options{}, stateFiles...)
+	require.NoError(t, err)
+
+	var compressed []string
+	for i, stateFile := range stateFiles {
+		b, err := os.ReadFile(stateFile)
+		require.NoError(t, err)
+		// The compression is detected by content, not by name
+		b, err = CompressFor([]string{"x.gz", "x.zst"}[i%2], b)
+		require.NoError(t, err)
+		path := filepath.Join(t.TempDir(), filepath.Base(stateFile))
+		require.NoError(t, os.WriteFile(path, b, 0600))
+		compressed = append(compressed, path)
+	}
+	actual, err := Merge(context.Background(), nil, Options{}, compressed...)
+	require.NoError(t, err)
+	require.Equal(t, string(expect), string(actual))
+}
@@ -0,0 +1,212 @@
+package tfmerge
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	tfjson "github.com/hashicorp/terraform-json"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// ------------------| Convert: FNs |------------------
+// A `terraform show -json` document can be converted back to a state file (format version 4), e.g. when only the
+// show-json exports of a state are kept. Most of the state is in the document:
+//   - The module tree is flattened into the module addresses of the resources
+//   - The index keys become the index_key of the instances, and the each mode of their resource
+//   - The sensitive_values become the sensitive_attributes of the instances
+//   - The provider names become references to the default configuration of the providers
+// The rest can't be recovered, it is reported as warnings: the lineage & serial, the private data of the instances,
+// the provider aliases, and the check results. The sensitive values nested in an attribute are recovered as object
+// attributes, which terraform ignores if they're map elements, as the document doesn't tell maps & objects apart.
+
+// ConvertShowJSON builds a state file (format version 4) from a `terraform show -json` document of a state.
+// The report warns about the fields that can't be recovered from the document.
+func ConvertShowJSON(b []byte) ([]byte, *Report, error) {
+	var doc tfjson.State
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, nil, fmt.Errorf("reading the show-json document: %v", err)
+	}
+	var report Report
+	var state State
+	state.init()
+	state.TerraformVersion = doc.TerraformVersion
+	state.Serial = 1
+	state.Outputs = make(map[string]interface{})
+	report.Warnings = append(report.Warnings, "the lineage and serial of the state are not in the show-json document, the state has no lineage and serial 1")
+
+	if doc.Values != nil {
+		for name, output := range doc.Values.Outputs {
+			typ := output.Type
+			if typ == cty.NilType {
+				// Older terraform doesn't show the type of the outputs, it's implied by the value instead
+				v, err := json.Marshal(output.Value)
+				if err != nil {
+					return nil, nil, err
+				}
+				if typ, err = ctyjson.ImpliedType(v); err != nil {
+					return nil, nil, fmt.Errorf("output %s: %v", name, err)
+				}
+			}
+			t, err := typ.MarshalJSON()
+			if err != nil {
+				return nil, nil, fmt.Errorf("output %s: %v", name, err)
+			}
+			out := map[string]interface{}{"value": output.Value, "type": json.RawMessage(t)}
+			if output.Sensitive {
+				out["sensitive"] = true
+			}
+			state.Outputs[name] = out
+		}
+		var nested []string
+		if err := state.convertModule(doc.Values.RootModule, &nested); err != nil {
+			return nil, nil, err
+		}
+		if len(nested) != 0 {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("the sensitive values nested in the attributes of %s are recovered as object attributes, they are not sensitive anymore if they're map elements", strings.Join(nested, ", ")))
+		}
+	}
+
+	var instances int
+	for _, res := range state.Resources {
+		instances += len(res.Instances)
+	}
+	if instances != 0 {
+		report.Warnings = append(report.Warnings,
+			fmt.Sprintf("the private data of the %d resource instances is not in the show-json document, it's left out", instances),
+			"the provider aliases of the resources are not in the show-json document, they use the default configuration of their provider")
+	}
+	var checks struct {
+		Checks []interface{} `json:"checks"`
+	}
+	if err := json.Unmarshal(b, &checks); err == nil && len(checks.Checks) != 0 {
+		report.Warnings = append(report.Warnings, "the check results are not converted, they are recorded again on the next apply")
+	}
+
+	state.sortResources()
+	out, err := marshalState(&state)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, &report, nil
+}
+
+// convertModule adds the resource instances of the module (and its child modules) to the state.
+// The instances having sensitive values nested in their attributes are added to nested, see sensitivePaths.
+func (state *State) convertModule(module *tfjson.StateModule, nested *[]string) error {
+	if module == nil {
+		return nil
+	}
+	for _, rsrc := range module.Resources {
+		addr := resourceAddr(module.Address, string(rsrc.Mode), rsrc.Type, rsrc.Name)
+		if rsrc.ProviderName == "" {
+			return fmt.Errorf("resource %s has no provider name", rsrc.Address)
+		}
+		instance := map[string]interface{}{
+			"schema_version": rsrc.SchemaVersion,
+			"attributes":     rsrc.AttributeValues,
+		}
+		if rsrc.AttributeValues == nil {
+			instance["attributes"] = map[string]interface{}{}
+		}
+		var each string
+		switch key := rsrc.Index.(type) {
+		case nil:
+		case float64:
+			each = "list"
+			instance["index_key"] = key
+		case string:
+			each = "map"
+			instance["index_key"] = key
+		default:
+			return fmt.Errorf("resource %s has an invalid index %v", rsrc.Address, rsrc.Index)
+		}
+		if rsrc.Tainted {
+			instance["status"] = "tainted"
+		}
+		if rsrc.DeposedKey != "" {
+			instance["deposed"] = rsrc.DeposedKey
+		}
+		sensitive := []interface{}{}
+		if len(rsrc.SensitiveValues) != 0 {
+			var v interface{}
+			if err := json.Unmarshal(rsrc.SensitiveValues, &v); err != nil {
+				return fmt.Errorf("resource %s has invalid sensitive values: %v", rsrc.Address, err)
+			}
+			sensitive = sensitivePaths(v, nil, sensitive)
+			if hasNestedAttr(sensitive) {
+				*nested = append(*nested, rsrc.Address)
+			}
+		}
+		instance["sensitive_attributes"] = sensitive
+		if len(rsrc.DependsOn) != 0 {
+			instance["dependencies"] = rsrc.DependsOn
+		}
+
+		// The instances of a resource are listed one by one
+		res := state.findResource(addr)
+		if res == nil {
+			state.Resources = append(state.Resources, Resource{
+				Module:   module.Address,
+				Mode:     string(rsrc.Mode),
+				Type:     rsrc.Type,
+				Name:     rsrc.Name,
+				Each:     each,
+				Provider: providerRef{source: normalizeProviderSource(rsrc.ProviderName)}.String(),
+			})
+			res = &state.Resources[len(state.Resources)-1]
+		}
+		res.Instances = append(res.Instances, instance)
+	}
+	for _, child := range module.ChildModules {
+		if err := state.convertModule(child, nested); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasNestedAttr reports whether any of the sensitive attribute paths has a get_attr step below the attribute of the instance,
+// i.e. an object attribute or a map element
+func hasNestedAttr(paths []interface{}) bool {
+	for _, p := range paths {
+		steps, _ := p.([]interface{})
+		for i, step := range steps {
+			if s, _ := step.(map[string]interface{}); i > 0 && s["type"] == "get_attr" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sensitivePaths appends the paths of the sensitive values (i.e. true) to the sensitive attributes, the reverse of sensitiveAsBool.
+// NOTE: the elements of maps & the attributes of objects look the same in the sensitive values, both become get_attr steps.
+func sensitivePaths(v interface{}, path []interface{}, paths []interface{}) []interface{} {
+	step := func(s interface{}) []interface{} {
+		return append(append([]interface{}{}, path...), s)
+	}
+	switch v := v.(type) {
+	case bool:
+		if v && len(path) != 0 {
+			paths = append(paths, path)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			paths = sensitivePaths(v[k], step(map[string]interface{}{"type": "get_attr", "value": k}), paths)
+		}
+	case []interface{}:
+		for i, child := range v {
+			index := map[string]interface{}{"type": "index", "value": map[string]interface{}{"value": i, "type": "number"}}
+			paths = sensitivePaths(child, step(index), paths)
+		}
+	}
+	return paths
+}
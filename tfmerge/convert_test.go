@@ -0,0 +1,165 @@
+package tfmerge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertShowJSON(t *testing.T) {
+	doc := []byte(`{
+  "format_version": "1.0",
+  "terraform_version": "1.5.7",
+  "values": {
+    "outputs": {
+      "name": {"sensitive": false, "value": "db", "type": "string"},
+      "ids": {"sensitive": true, "value": ["a", "b"]}
+    },
+    "root_module": {
+      "resources": [
+        {
+          "address": "db.test[\"b\"]",
+          "mode": "managed",
+          "type": "db",
+          "name": "test",
+          "index": "b",
+          "provider_name": "registry.terraform.io/hashicorp/db",
+          "schema_version": 2,
+          "values": {"id": "db-b", "password": "hunter2", "users": [{"token": "t0k3n"}, {"token": null}]},
+          "sensitive_values": {"password": true, "users": [{"token": true}, {}]},
+          "depends_on": ["data.db.read"],
+          "tainted": true
+        },
+        {
+          "address": "db.test[\"b\"]",
+          "mode": "managed",
+          "type": "db",
+          "name": "test",
+          "index": "b",
+          "provider_name": "registry.terraform.io/hashicorp/db",
+          "schema_version": 2,
+          "values": {"id": "db-old"},
+          "sensitive_values": {},
+          "deposed_key": "00000001"
+        },
+        {
+          "address": "data.db.read",
+          "mode": "data",
+          "type": "db",
+          "name": "read",
+          "provider_name": "registry.terraform.io/hashicorp/db",
+          "schema_version": 0,
+          "values": {"id": "r"},
+          "sensitive_values": {}
+        }
+      ],
+      "child_modules": [
+        {
+          "address": "module.a[0]",
+          "child_modules": [
+            {
+              "resources": [
+                {
+                  "address": "module.a[0].module.b.null_resource.nested[1]",
+                  "mode": "managed",
+                  "type": "null_resource",
+                  "name": "nested",
+                  "index": 1,
+                  "provider_name": "registry.terraform.io/hashicorp/null",
+                  "schema_version": 0,
+                  "values": {"id": "1"},
+                  "sensitive_values": {}
+                }
+              ],
+              "address": "module.a[0].module.b"
+            }
+          ]
+        }
+      ]
+    }
+  }
+}`)
+
+	b, report, err := ConvertShowJSON(doc)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+  "version": 4,
+  "terraform_version": "1.5.7",
+  "serial": 1,
+  "outputs": {
+    "ids": {"value": ["a", "b"], "type": ["tuple", ["string", "string"]], "sensitive": true},
+    "name": {"value": "db", "type": "string"}
+  },
+  "resources": [
+    {
+      "mode": "data",
+      "type": "db",
+      "name": "read",
+      "provider": "provider[\"registry.terraform.io/hashicorp/db\"]",
+      "instances": [
+        {"schema_version": 0, "attributes": {"id": "r"}, "sensitive_attributes": []}
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "db",
+      "name": "test",
+      "each": "map",
+      "provider": "provider[\"registry.terraform.io/hashicorp/db\"]",
+      "instances": [
+        {
+          "index_key": "b",
+          "status": "tainted",
+          "schema_version": 2,
+          "attributes": {"id": "db-b", "password": "hunter2", "users": [{"token": "t0k3n"}, {"token": null}]},
+          "sensitive_attributes": [[{"type": "get_attr", "value": "password"}], [{"type": "get_attr", "value": "users"}, {"type": "index", "value": {"value": 0, "type": "number"}}, {"type": "get_attr", "value": "token"}]],
+          "dependencies": ["data.db.read"]
+        },
+        {
+          "index_key": "b",
+          "deposed": "00000001",
+          "schema_version": 2,
+          "attributes": {"id": "db-old"},
+          "sensitive_attributes": []
+        }
+      ]
+    },
+    {
+      "module": "module.a[0].module.b",
+      "mode": "managed",
+      "type": "null_resource",
+      "name": "nested",
+      "each": "list",
+      "provider": "provider[\"registry.terraform.io/hashicorp/null\"]",
+      "instances": [
+        {"index_key": 1, "schema_version": 0, "attributes": {"id": "1"}, "sensitive_attributes": []}
+      ]
+    }
+  ],
+  "check_results": null
+}`, string(b))
+	require.Len(t, report.Warnings, 4)
+	require.Contains(t, report.Warnings[0], "lineage")
+	// users[0].token might be a map element
+	require.Contains(t, report.Warnings[1], `the sensitive values nested in the attributes of db.test["b"] are recovered as object attributes`)
+	require.Contains(t, report.Warnings[2], "private data of the 4 resource instances")
+
+	// The state converted from its own show-json document is the same
+	shown, err := ShowJSON(b)
+	require.NoError(t, err)
+	b2, _, err := ConvertShowJSON(shown)
+	require.NoError(t, err)
+	require.Equal(t, string(b), string(b2))
+
+	_, _, err = ConvertShowJSON([]byte(`{"format_version": "1.0", "values": {"root_module": {"resources": [{"address": "a.b", "mode": "managed", "type": "a", "name": "b"}]}}}`))
+	require.Error(t, err)
+}
+
+func TestHasNestedAttr(t *testing.T) {
+	attr := func(name string) interface{} { return map[string]interface{}{"type": "get_attr", "value": name} }
+	index := map[string]interface{}{"type": "index", "value": map[string]interface{}{"value": 0, "type": "number"}}
+	require.False(t, hasNestedAttr(nil))
+	require.False(t, hasNestedAttr([]interface{}{[]interface{}{attr("password")}, []interface{}{attr("ids"), index}}))
+	require.True(t, hasNestedAttr([]interface{}{[]interface{}{attr("tags"), attr("secret")}}))
+	require.True(t, hasNestedAttr([]interface{}{[]interface{}{attr("users"), index, attr("token")}}))
+}
@@ -0,0 +1,125 @@
+package tfmerge
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ------------------| Discover: FNs |------------------
+
+// defaultDiscoverGlobs match the state files written by terraform (and tools like aztfexport or terraformer), and their compressed archives
+var defaultDiscoverGlobs = []string{"*.tfstate", "*.tfstate.gz", "*.tfstate.zst"}
+
+// DiscoverOptions controls which files Discover finds.
+type DiscoverOptions struct {
+	Globs        []string // The file names to find (default: *.tfstate, *.tfstate.gz & *.tfstate.zst)
+	Ignore       []string // The files & directories to skip, matched against their name and their path relative to the walked directory
+	Backups      bool     // Also find the *.backup files of the matched file names
+	TerraformDir bool     // Also walk into the .terraform directories
+}
+
+// DiscoveredFile is a state file found by Discover.
+type DiscoveredFile struct {
+	Path   string
+	Module string // The module address derived from the path relative to the walked directory, empty for the root module
+}
+
+// Discover walks the directory tree for state files. Each one is put under a module derived from its relative path,
+// e.g. "network/vpc/terraform.tfstate" goes to "module.network.module.vpc" and "network/prod.tfstate" to "module.network.module.prod".
+func Discover(dir string, opts DiscoverOptions) ([]DiscoveredFile, error) {
+	globs := opts.Globs
+	if len(globs) == 0 {
+		globs = defaultDiscoverGlobs
+	}
+	for _, pattern := range append(append([]string{}, globs...), opts.Ignore...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+
+	var files []DiscoveredFile
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if matchAny(opts.Ignore, d.Name()) || matchAny(opts.Ignore, rel) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == ".terraform" && !opts.TerraformDir {
+				return fs.SkipDir
+			}
+			// The backups recorded by tfmerge itself
+			if d.Name() == ".tfmerge" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		name := d.Name()
+		if strings.HasSuffix(name, ".backup") {
+			if !opts.Backups {
+				return nil
+			}
+			if !matchAny(globs, name) {
+				name = strings.TrimSuffix(name, ".backup")
+			}
+		}
+		if !matchAny(globs, name) {
+			return nil
+		}
+		files = append(files, DiscoveredFile{Path: p, Module: discoveredModule(rel)})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("discovering state files in %s: %v", dir, err)
+	}
+	return files, nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// discoveredModule derives the module address of a discovered state file from its (slash separated) relative path.
+// Each directory is a module, so is the file name unless it is the default terraform.tfstate.
+func discoveredModule(rel string) string {
+	dir, file := path.Split(rel)
+	stem := trimCompressionExt(strings.TrimSuffix(file, ".backup"))
+	stem = strings.TrimSuffix(stem, path.Ext(stem))
+
+	var names []string
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		names = strings.Split(dir, "/")
+	}
+	if stem != "terraform" && stem != "" {
+		names = append(names, stem)
+	}
+	var addr []string
+	for _, name := range names {
+		addr = append(addr, "module."+moduleName(name))
+	}
+	return strings.Join(addr, ".")
+}
@@ -0,0 +1,87 @@
+package tfmerge
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscover(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{
+		"terraform.tfstate",
+		"terraform.tfstate.backup",
+		"network/vpc/terraform.tfstate",
+		"network/prod.tfstate",
+		"archive/old.tfstate.gz",
+		"network/.terraform/terraform.tfstate",
+		".tfmerge/20221012T000000.000000000Z.tfstate",
+		"my app/terraform.tfstate",
+		"skipme/terraform.tfstate",
+		"notes.txt",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte("{}"), 0644))
+	}
+
+	discovered := func(opts DiscoverOptions) map[string]string {
+		files, err := Discover(dir, opts)
+		require.NoError(t, err)
+		m := make(map[string]string)
+		for _, f := range files {
+			rel, err := filepath.Rel(dir, f.Path)
+			require.NoError(t, err)
+			m[filepath.ToSlash(rel)] = f.Module
+		}
+		return m
+	}
+
+	require.Equal(t, map[string]string{
+		"terraform.tfstate":             "",
+		"network/vpc/terraform.tfstate": "module.network.module.vpc",
+		"network/prod.tfstate":          "module.network.module.prod",
+		"archive/old.tfstate.gz":        "module.archive.module.old",
+		"my app/terraform.tfstate":      "module.my_app",
+	}, discovered(DiscoverOptions{Ignore: []string{"skipme"}}))
+
+	require.Equal(t, map[string]string{
+		"terraform.tfstate":                    "",
+		"terraform.tfstate.backup":             "",
+		"network/.terraform/terraform.tfstate": "module.network.module._terraform",
+	}, discovered(DiscoverOptions{Ignore: []string{"network/*.tfstate", "vpc", "archive", "my app", "skipme"}, Backups: true, TerraformDir: true}))
+
+	_, err := Discover(dir, DiscoverOptions{Globs: []string{"["}})
+	require.Error(t, err)
+}
+
+func TestMoveToModule(t *testing.T) {
+	state := map[string]interface{}{
+		"resources": []interface{}{
+			map[string]interface{}{
+				"mode": "managed", "type": "null_resource", "name": "a",
+				"provider":  `provider["registry.terraform.io/hashicorp/null"]`,
+				"instances": []interface{}{map[string]interface{}{"dependencies": []interface{}{"module.m.null_resource.b"}}},
+			},
+			map[string]interface{}{
+				"module": "module.m", "mode": "managed", "type": "null_resource", "name": "b",
+				"provider":  `module.m.provider["registry.terraform.io/hashicorp/null"]`,
+				"instances": []interface{}{map[string]interface{}{}},
+			},
+		},
+	}
+	moveToModule(state, "module.p")
+	resources := state["resources"].([]interface{})
+	a, b := resources[0].(map[string]interface{}), resources[1].(map[string]interface{})
+	require.Equal(t, "module.p", a["module"])
+	require.Equal(t, `provider["registry.terraform.io/hashicorp/null"]`, a["provider"])
+	require.Equal(t, []interface{}{"module.p.module.m.null_resource.b"}, a["instances"].([]interface{})[0].(map[string]interface{})["dependencies"])
+	require.Equal(t, "module.p.module.m", b["module"])
+	require.Equal(t, `module.p.module.m.provider["registry.terraform.io/hashicorp/null"]`, b["provider"])
+
+	require.NoError(t, validateModuleAddr("module.a.module.b-c"))
+	require.Error(t, validateModuleAddr("module.a[0]"))
+	require.Error(t, validateModuleAddr("a"))
+}
@@ -0,0 +1,76 @@
+package tfmerge
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// ------------------| Encryption: FNs |------------------
+// State files encrypted with age (binary or armored) are detected by their header, and decrypted in memory.
+
+var (
+	ageHeader      = []byte("age-encryption.org/v1\n")
+	ageArmorHeader = []byte(armor.Header)
+)
+
+// IsEncrypted reports whether the state file is encrypted with age
+func IsEncrypted(b []byte) bool {
+	b = bytes.TrimLeft(b, " \t\r\n")
+	return bytes.HasPrefix(b, ageHeader) || bytes.HasPrefix(b, ageArmorHeader)
+}
+
+// Decrypt decrypts an age encrypted state file with the identities, other content is returned as is.
+func Decrypt(b []byte, identities []age.Identity) ([]byte, error) {
+	if !IsEncrypted(b) {
+		return b, nil
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("encrypted with age, but no identity is given to decrypt it")
+	}
+	var src io.Reader = bytes.NewReader(b)
+	if bytes.HasPrefix(bytes.TrimLeft(b, " \t\r\n"), ageArmorHeader) {
+		src = armor.NewReader(bufio.NewReader(src))
+	}
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting: %v", err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting: %v", err)
+	}
+	return out, nil
+}
+
+// Encrypt encrypts the state file to the recipients with age, it's returned as is without any recipient.
+func Encrypt(b []byte, recipients []age.Recipient) ([]byte, error) {
+	if len(recipients) == 0 {
+		return b, nil
+	}
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting: %v", err)
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, fmt.Errorf("encrypting: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("encrypting: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// readStateBytes turns the content of a state file into its plain JSON: decrypted first, then decompressed
+func readStateBytes(b []byte, identities []age.Identity) ([]byte, error) {
+	b, err := Decrypt(b, identities)
+	if err != nil {
+		return nil, err
+	}
+	return Decompress(b)
+}
@@ -0,0 +1,71 @@
+package tfmerge
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	state := []byte(`{"version": 4, "serial": 1}`)
+
+	b, err := Encrypt(state, []age.Recipient{identity.Recipient()})
+	require.NoError(t, err)
+	require.True(t, IsEncrypted(b))
+	out, err := Decrypt(b, []age.Identity{other, identity})
+	require.NoError(t, err)
+	require.Equal(t, state, out)
+
+	_, err = Decrypt(b, nil)
+	require.ErrorContains(t, err, "no identity")
+	_, err = Decrypt(b, []age.Identity{other})
+	require.Error(t, err)
+
+	// Armored
+	var buf bytes.Buffer
+	w := armor.NewWriter(&buf)
+	_, err = w.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	out, err = Decrypt(buf.Bytes(), []age.Identity{identity})
+	require.NoError(t, err)
+	require.Equal(t, state, out)
+
+	// Not encrypted
+	out, err = Decrypt(state, nil)
+	require.NoError(t, err)
+	require.Equal(t, state, out)
+}
+
+func TestMergeEncrypted(t *testing.T) {
+	initTest(t)
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	stateFiles, _ := testFixture(t, "resource_only")
+	expect, err := Merge(context.Background(), nil, Options{}, stateFiles...)
+	require.NoError(t, err)
+
+	// Compressed, then encrypted
+	var readers []NamedReader
+	for _, stateFile := range stateFiles {
+		b, err := os.ReadFile(stateFile)
+		require.NoError(t, err)
+		b, err = CompressFor("x.gz", b)
+		require.NoError(t, err)
+		b, err = Encrypt(b, []age.Recipient{identity.Recipient()})
+		require.NoError(t, err)
+		readers = append(readers, NamedReader{Name: stateFile, Reader: bytes.NewReader(b)})
+	}
+	actual, _, err := MergeReaders(context.Background(), nil, Options{Identities: []age.Identity{identity}}, readers)
+	require.NoError(t, err)
+	require.Equal(t, string(expect), string(actual))
+}
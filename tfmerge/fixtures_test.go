@@ -0,0 +1,45 @@
+package tfmerge
+
+// testInstance builds a decoded resource instance with the id attribute, the fields are the other keys and values in pairs.
+// Integers are turned into float64, like the numbers decoded from JSON.
+func testInstance(id string, fields ...interface{}) map[string]interface{} {
+	instance := map[string]interface{}{"attributes": map[string]interface{}{"id": id}}
+	for i := 0; i+1 < len(fields); i += 2 {
+		value := fields[i+1]
+		if n, ok := value.(int); ok {
+			value = float64(n)
+		}
+		instance[fields[i].(string)] = value
+	}
+	return instance
+}
+
+// testResource builds a resource of the instances.
+func testResource(module, mode, typ, name string, instances ...map[string]interface{}) Resource {
+	res := Resource{Module: module, Mode: mode, Type: typ, Name: name}
+	for _, instance := range instances {
+		res.Instances = append(res.Instances, instance)
+	}
+	return res
+}
+
+// testInput builds a decoded state file of the resources, read from path.
+func testInput(path, lineage string, serial int, resources ...Resource) stateInput {
+	var rawResources []interface{}
+	for _, res := range resources {
+		raw := map[string]interface{}{"mode": res.Mode, "type": res.Type, "name": res.Name, "instances": res.Instances}
+		if res.Module != "" {
+			raw["module"] = res.Module
+		}
+		rawResources = append(rawResources, raw)
+	}
+	return stateInput{
+		path: path,
+		state: map[string]interface{}{
+			"version":   float64(4),
+			"serial":    float64(serial),
+			"lineage":   lineage,
+			"resources": rawResources,
+		},
+	}
+}
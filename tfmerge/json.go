@@ -1,91 +1,229 @@
 package tfmerge
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 // ---------------|JSON MARSHALLING|---------------
 
 func (state *State) MarshalJSON() ([]byte, error) {
-	values, _ := json.Marshal(state.Resources)
-	// checks, _ := state.Checks.MarshalJSON()
-	// outputs, _ := state.Outputs
+	resources := state.Resources
+	if resources == nil {
+		resources = []Resource{}
+	}
+	values, err := json.Marshal(resources)
+	if err != nil {
+		return nil, err
+	}
+	// The outputs are objects of value, type and sensitive
+	outputs := make(map[string]interface{})
+	for name, output := range state.Outputs {
+		outputs[name] = orderFields(output, outputFieldOrder)
+	}
 
-	return json.Marshal(&struct {
-		Checks           json.RawMessage        `json:"check_results"`
+	// Fields are in the order of terraform's state file
+	b, err := json.Marshal(&struct {
 		Version          int                    `json:"version"`
 		TerraformVersion string                 `json:"terraform_version,omitempty"`
 		Serial           int                    `json:"serial"`
 		Lineage          string                 `json:"lineage,omitempty"` //364d8449-e325-c78f-132a-c1c5791fec40
 		Outputs          map[string]interface{} `json:"outputs"`
 		Resources        json.RawMessage        `json:"resources,omitempty"`
+		Checks           json.RawMessage        `json:"check_results"`
 	}{
-		Checks:           state.Checks,
 		Version:          state.Version,
-		Serial:           state.Serial,
 		TerraformVersion: state.TerraformVersion,
+		Serial:           state.Serial,
+		Lineage:          state.Lineage,
+		Outputs:          outputs,
 		Resources:        values,
-		Outputs:          state.Outputs,
+		Checks:           state.Checks,
 	})
+	if err != nil {
+		return nil, err
+	}
+	return appendExtra(b, state.Extra, stateFields)
 }
 
-func (sv *StateValues) MarshalJSON() ([]byte, error) {
-	rootmod, err := json.Marshal(sv.RootModule)
+func (state *State) UnmarshalJSON(b []byte) error {
+	type plain State // Without the methods, to not recurse
+	if err := json.Unmarshal(b, (*plain)(state)); err != nil {
+		return err
+	}
+	extra, err := unknownFieldsJSON(b, stateFields)
 	if err != nil {
-		return nil, fmt.Errorf("reading from merged state file %s: %v", "---|StateValues.RootModule.MarshalJSON()|---", err)
+		return err
 	}
-	return json.Marshal(&struct {
-		Outputs    json.RawMessage `json:"outputs,omitempty"`
-		RootModule json.RawMessage `json:"root_module,omitempty"`
-	}{
-		// Outputs:    output,
-		RootModule: rootmod,
-	})
+	state.Extra = extra
+	return nil
 }
 
-func (sm *StateModule) MarshalJSON() ([]byte, error) {
-	instances, err := json.Marshal(sm.Resources)
+func (res Resource) MarshalJSON() ([]byte, error) {
+	type plain Resource // Without the methods, to not recurse
+	// The instance fields are in the order of terraform's state file
+	instances := make([]interface{}, 0, len(res.Instances))
+	for _, instance := range res.Instances {
+		instances = append(instances, orderFields(instance, instanceFieldOrder))
+	}
+	res.Instances = instances
+	b, err := json.Marshal(plain(res))
 	if err != nil {
-		return nil, fmt.Errorf("reading from merged state file %s: %v", "---|StateModule.Resources.MarshalJSON()|---", err)
+		return nil, err
+	}
+	return appendExtra(b, res.Extra, resourceFields)
+}
+
+func (res *Resource) UnmarshalJSON(b []byte) error {
+	type plain Resource // Without the methods, to not recurse
+	if err := json.Unmarshal(b, (*plain)(res)); err != nil {
+		return err
+	}
+	extra, err := unknownFieldsJSON(b, resourceFields)
+	if err != nil {
+		return err
+	}
+	res.Extra = extra
+	return nil
+}
+
+// ---------------|UNKNOWN FIELDS|---------------
+
+// The JSON field names known to the State and Resource
+var (
+	stateFields    = jsonFieldNames(State{})
+	resourceFields = jsonFieldNames(Resource{})
+)
+
+// jsonFieldNames returns the JSON names of the fields of the struct
+func jsonFieldNames(v interface{}) map[string]bool {
+	names := make(map[string]bool)
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// unknownFields returns the fields of the decoded JSON object that are not known; nil if there is none
+func unknownFields(obj map[string]interface{}, known map[string]bool) map[string]interface{} {
+	var extra map[string]interface{}
+	for k, v := range obj {
+		if known[k] {
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string]interface{})
+		}
+		extra[k] = v
+	}
+	return extra
+}
+
+func unknownFieldsJSON(b []byte, known map[string]bool) (map[string]interface{}, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, err
+	}
+	return unknownFields(obj, known), nil
+}
+
+// appendExtra appends the extra fields (sorted by name) to the marshalled JSON object, the known fields are never overridden
+func appendExtra(b []byte, extra map[string]interface{}, known map[string]bool) ([]byte, error) {
+	var keys []string
+	for k := range extra {
+		if !known[k] {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return b, nil
+	}
+	sort.Strings(keys)
+
+	buf := bytes.NewBuffer(bytes.TrimSuffix(bytes.TrimSpace(b), []byte("}")))
+	for i, k := range keys {
+		if i != 0 || !bytes.HasSuffix(buf.Bytes(), []byte("{")) {
+			buf.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		vb, err := json.Marshal(extra[k])
+		if err != nil {
+			return nil, fmt.Errorf("marshalling field %s: %v", k, err)
+		}
+		buf.Write(kb)
+		buf.WriteByte(':')
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// ---------------|SHOW JSON|---------------
+// The module tree is marshalled in the format of `terraform show -json`, the fields are in the order terraform writes them.
+
+func (sm *StateModule) MarshalJSON() ([]byte, error) {
+	resources := make([]*StateResource, 0, len(sm.Resources))
+	for _, res := range sm.Resources {
+		resources = append(resources, (*StateResource)(res))
+	}
+	children := make([]*StateModule, 0, len(sm.ChildModules))
+	for _, child := range sm.ChildModules {
+		children = append(children, (*StateModule)(child))
 	}
 	return json.Marshal(&struct {
-		Module    string          `json:"module,omitempty"`
-		Mode      string          `json:"mode,omitempty"`
-		Type      string          `json:"type,omitempty"`
-		Name      string          `json:"name,omitempty"`
-		Provider  string          `json:"provider,omitempty"`
-		Instances json.RawMessage `json:"instances,omitempty"`
+		Resources    []*StateResource `json:"resources,omitempty"`
+		Address      string           `json:"address,omitempty"`
+		ChildModules []*StateModule   `json:"child_modules,omitempty"`
 	}{
-		Module:    "",
-		Mode:      "",
-		Type:      "",
-		Name:      "",
-		Provider:  "",
-		Instances: instances,
+		Resources:    resources,
+		Address:      sm.Address,
+		ChildModules: children,
 	})
 }
 
 func (sr *StateResource) MarshalJSON() ([]byte, error) {
-	attr, err := json.Marshal(sr.AttributeValues)
-	if err != nil {
-		return nil, fmt.Errorf("reading from merged state file %s: %v", "---|StateResource.AttributeValues.MarshalJSON()|---", err)
+	// The values & sensitive values are always written, even if empty
+	values := sr.AttributeValues
+	if values == nil {
+		values = map[string]interface{}{}
 	}
-	secrets, err := sr.SensitiveValues.MarshalJSON()
-	if err != nil {
-		return nil, fmt.Errorf("reading from merged state file %s: %v", "---|StateResource.SensitiveValues.MarshalJSON()|---", err)
+	sensitive := sr.SensitiveValues
+	if len(sensitive) == 0 {
+		sensitive = json.RawMessage("{}")
 	}
 	return json.Marshal(&struct {
-		DependsOn       []string        `json:"dependencies,omitempty"`
-		Private         string          `json:"private,omitempty"`
-		SchemaVersion   uint64          `json:"schema_version,omitempty"`
-		AttributeValues json.RawMessage `json:"attributes,omitempty"`
-		SensitiveValues json.RawMessage `json:"sensitive_attributes,omitempty"`
+		Address         string                 `json:"address"`
+		Mode            string                 `json:"mode"`
+		Type            string                 `json:"type"`
+		Name            string                 `json:"name"`
+		Index           interface{}            `json:"index,omitempty"`
+		ProviderName    string                 `json:"provider_name"`
+		SchemaVersion   uint64                 `json:"schema_version"`
+		AttributeValues map[string]interface{} `json:"values"`
+		SensitiveValues json.RawMessage        `json:"sensitive_values"`
+		DependsOn       []string               `json:"depends_on,omitempty"`
+		Tainted         bool                   `json:"tainted,omitempty"`
+		DeposedKey      string                 `json:"deposed_key,omitempty"`
 	}{
-		DependsOn:       []string{""},
-		Private:         "",
-		SchemaVersion:   0,
-		AttributeValues: attr,
-		SensitiveValues: secrets,
+		Address:         sr.Address,
+		Mode:            string(sr.Mode),
+		Type:            sr.Type,
+		Name:            sr.Name,
+		Index:           sr.Index,
+		ProviderName:    sr.ProviderName,
+		SchemaVersion:   sr.SchemaVersion,
+		AttributeValues: values,
+		SensitiveValues: sensitive,
+		DependsOn:       sr.DependsOn,
+		Tainted:         sr.Tainted,
+		DeposedKey:      sr.DeposedKey,
 	})
 }
@@ -0,0 +1,88 @@
+package tfmerge
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// ------------------| Lineage: FNs |------------------
+
+// dedupeLineage groups the state files by lineage, as the state files of the same lineage are snapshots of the same state.
+// Only the highest serial snapshot of each lineage is kept, the others are recorded as superseded in the report.
+// Snapshots of the same serial are kept as well unless they are identical, as they have diverged from each other.
+// In strict mode, any lineage shared by multiple state files is an error instead.
+func dedupeLineage(inputs []stateInput, strict bool, report *Report) ([]stateInput, error) {
+	var result *multierror.Error
+	var lineages []string
+	groups := make(map[string][]int)
+	for i, input := range inputs {
+		lineage, _ := input.state["lineage"].(string)
+		if lineage == "" {
+			continue
+		}
+		if _, ok := groups[lineage]; !ok {
+			lineages = append(lineages, lineage)
+		}
+		groups[lineage] = append(groups[lineage], i)
+	}
+
+	drop := make(map[int]bool)
+	for _, lineage := range lineages {
+		group := groups[lineage]
+		if len(group) < 2 {
+			continue
+		}
+		if strict {
+			var paths []string
+			for _, i := range group {
+				paths = append(paths, inputs[i].path)
+			}
+			result = multierror.Append(result, fmt.Errorf("state files %s share the same lineage %s", strings.Join(paths, ", "), lineage))
+			continue
+		}
+
+		newest := group[0]
+		for _, i := range group[1:] {
+			if stateSerial(inputs[i].state) > stateSerial(inputs[newest].state) {
+				newest = i
+			}
+		}
+		for _, i := range group {
+			if i == newest {
+				continue
+			}
+			serial, newestSerial := stateSerial(inputs[i].state), stateSerial(inputs[newest].state)
+			if serial == newestSerial && !reflect.DeepEqual(inputs[i].state, inputs[newest].state) {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("state files %s and %s share the lineage %s and serial %d but have diverged, both are merged", inputs[i].path, inputs[newest].path, lineage, serial))
+				continue
+			}
+			drop[i] = true
+			report.Superseded = append(report.Superseded, Superseded{
+				StateFile: inputs[i].path,
+				Serial:    serial,
+				Lineage:   lineage,
+				By:        inputs[newest].path,
+				BySerial:  newestSerial,
+			})
+		}
+	}
+	if err := result.ErrorOrNil(); err != nil {
+		return nil, err
+	}
+
+	var kept []stateInput
+	for i, input := range inputs {
+		if !drop[i] {
+			kept = append(kept, input)
+		}
+	}
+	return kept, nil
+}
+
+func stateSerial(state map[string]interface{}) int {
+	serial, _ := state["serial"].(float64)
+	return int(serial)
+}
@@ -0,0 +1,51 @@
+package tfmerge
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupeLineage(t *testing.T) {
+	inputs := []stateInput{
+		testInput("old", "aaaa", 1, testResource("", "managed", "null_resource", "x")),
+		testInput("other", "bbbb", 1, testResource("", "managed", "null_resource", "y")),
+		testInput("new", "aaaa", 3, testResource("", "managed", "null_resource", "x")),
+		testInput("copy", "aaaa", 3, testResource("", "managed", "null_resource", "x")),
+		testInput("diverged", "bbbb", 1, testResource("", "managed", "null_resource", "z")),
+	}
+
+	var report Report
+	kept, err := dedupeLineage(inputs, false, &report)
+	require.NoError(t, err)
+
+	var paths []string
+	for _, input := range kept {
+		paths = append(paths, input.path)
+	}
+	require.Equal(t, []string{"other", "new", "diverged"}, paths)
+	require.Equal(t, []Superseded{
+		{StateFile: "old", Serial: 1, Lineage: "aaaa", By: "new", BySerial: 3},
+		{StateFile: "copy", Serial: 3, Lineage: "aaaa", By: "new", BySerial: 3},
+	}, report.Superseded)
+	require.Equal(t, []string{"state files diverged and other share the lineage bbbb and serial 1 but have diverged, both are merged"}, report.Warnings)
+	// Each superseded state file is reported once
+	require.Equal(t, 1, strings.Count(report.String(), "old (serial 1)"))
+}
+
+func TestDedupeLineageStrict(t *testing.T) {
+	inputs := []stateInput{
+		testInput("old", "aaaa", 1, testResource("", "managed", "null_resource", "x")),
+		testInput("other", "bbbb", 1, testResource("", "managed", "null_resource", "y")),
+		testInput("new", "aaaa", 3, testResource("", "managed", "null_resource", "x")),
+	}
+
+	var report Report
+	_, err := dedupeLineage(inputs, true, &report)
+	require.ErrorContains(t, err, "old, new")
+
+	kept, err := dedupeLineage(inputs[:2], true, &report)
+	require.NoError(t, err)
+	require.Len(t, kept, 2)
+}
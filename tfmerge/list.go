@@ -0,0 +1,154 @@
+package tfmerge
+
+import (
+	"fmt"
+	"path"
+
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// ------------------| List: FNs |------------------
+// The resource instances of the state files can be listed before merging them, to see what is in each of them and
+// where they would conflict. The conflicts are the ones the merge would hit with the same options and the default resolution,
+// i.e. Options.Resolution is ignored:
+//   - A resource defined in more than one state file conflicts, even if their instances don't overlap
+//   - Data sources only conflict if opts.DataSources is "keep", they are deduped or dropped otherwise
+//   - The state files superseded by a newer snapshot of their lineage aren't merged, so they conflict with nothing
+
+// ListOptions controls which resource instances List returns.
+type ListOptions struct {
+	// Addresses are globs matched against the resource & instance addresses, in the syntax of path.Match like the globs of
+	// DiscoverOptions & RedactOptions, e.g. "module.network.*" or `aws_instance.web\[0\]` (brackets are character classes,
+	// escape them to match the index keys). All the instances are listed if empty.
+	Addresses []string
+	// ConflictsOnly only lists the instances of the resources defined in more than one state file, which the merge
+	// refuses with the default resolution.
+	ConflictsOnly bool
+}
+
+// ListEntry is a resource instance of a state file.
+type ListEntry struct {
+	Address   string `json:"address"`
+	StateFile string `json:"state_file"`
+	Provider  string `json:"provider"`
+	// Each is the each mode of the resource: "list" (count), "map" (for_each), or "" for a single instance
+	Each string `json:"each"`
+	// Status is "current", "tainted" or "deposed"
+	Status     string `json:"status"`
+	DeposedKey string `json:"deposed_key,omitempty"`
+	// Conflict is whether the resource is defined in other state files as well, see ListEntry.ConflictsWith
+	Conflict      bool     `json:"conflict"`
+	ConflictsWith []string `json:"conflicts_with,omitempty"`
+}
+
+// List lists the resource instances of the base state (if any) and the state files, in their order.
+// The state files are read the same way as MergeReaders does with the options, the report lists the superseded state files.
+func List(pulledState []byte, opts Options, listOpts ListOptions, stateFiles []NamedReader) ([]ListEntry, *Report, error) {
+	for _, glob := range listOpts.Addresses {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, nil, fmt.Errorf("invalid address glob %q: %v", glob, err)
+		}
+	}
+	var report Report
+	inputs, _, err := readInputs(pulledState, opts.Identities, stateFiles, &report)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged, err := dedupeLineage(inputs, false, &report)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The state files defining each resource, among the merged ones
+	definedIn := make(map[string][]string)
+	for _, input := range merged {
+		resources, _ := input.state["resources"].([]interface{})
+		for _, r := range resources {
+			res, ok := r.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if res["mode"] == string(tfjson.DataResourceMode) && opts.DataSources != "keep" {
+				continue
+			}
+			addr := rawResourceAddr(res)
+			if files := definedIn[addr]; len(files) == 0 || files[len(files)-1] != input.path {
+				definedIn[addr] = append(files, input.path)
+			}
+		}
+	}
+	isMerged := make(map[string]bool)
+	for _, input := range merged {
+		isMerged[input.path] = true
+	}
+
+	var entries []ListEntry
+	for _, input := range inputs {
+		state, err := canonicalState(input.state)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading state file %s: %v", input.path, err)
+		}
+		for _, res := range state.Resources {
+			addr := resourceAddr(res.Module, res.Mode, res.Type, res.Name)
+			var others []string
+			if isMerged[input.path] && len(definedIn[addr]) > 1 {
+				for _, file := range definedIn[addr] {
+					if file != input.path {
+						others = append(others, file)
+					}
+				}
+			}
+			if listOpts.ConflictsOnly && len(others) == 0 {
+				continue
+			}
+			for _, inst := range res.Instances {
+				instance, ok := inst.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				entry := ListEntry{
+					Address:       instanceAddr(addr, instance["index_key"]),
+					StateFile:     input.path,
+					Provider:      res.Provider,
+					Each:          res.Each,
+					Status:        "current",
+					Conflict:      len(others) != 0,
+					ConflictsWith: others,
+				}
+				switch {
+				case isDeposed(instance):
+					entry.Status = "deposed"
+					entry.DeposedKey, _ = instance["deposed"].(string)
+				case isTainted(instance):
+					entry.Status = "tainted"
+				}
+				if len(listOpts.Addresses) != 0 && !matchAddress(listOpts.Addresses, addr, entry.Address) {
+					continue
+				}
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, &report, nil
+}
+
+// matchAddress reports whether any of the address globs matches the resource or instance address
+func matchAddress(globs []string, addrs ...string) bool {
+	for _, glob := range globs {
+		for _, addr := range addrs {
+			if ok, _ := path.Match(glob, addr); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rawResourceAddr returns the address of a resource of a decoded stateFile
+func rawResourceAddr(res map[string]interface{}) string {
+	module, _ := res["module"].(string)
+	mode, _ := res["mode"].(string)
+	typ, _ := res["type"].(string)
+	name, _ := res["name"].(string)
+	return resourceAddr(module, mode, typ, name)
+}
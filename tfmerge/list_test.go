@@ -0,0 +1,123 @@
+package tfmerge
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestList(t *testing.T) {
+	state := func(lineage string, serial int, resources string) string {
+		return `{"version": 4, "serial": ` + strconv.Itoa(serial) + `, "lineage": "` + lineage + `", "outputs": {}, "resources": [` + resources + `]}`
+	}
+	const provider = `"provider": "provider[\"registry.terraform.io/hashicorp/null\"]"`
+	web := `{"mode": "managed", "type": "null_resource", "name": "web", "each": "list", ` + provider + `, "instances": [
+		{"index_key": 1, "schema_version": 0, "attributes": {"id": "w1"}},
+		{"index_key": 0, "status": "tainted", "schema_version": 0, "attributes": {"id": "w0"}},
+		{"index_key": 0, "deposed": "00000001", "schema_version": 0, "attributes": {"id": "w0-old"}}
+	]}`
+	web2 := `{"mode": "managed", "type": "null_resource", "name": "web", "each": "list", ` + provider + `, "instances": [
+		{"index_key": 2, "schema_version": 0, "attributes": {"id": "w2"}}
+	]}`
+	db := `{"mode": "managed", "type": "null_resource", "name": "db", ` + provider + `, "instances": [{"schema_version": 0, "attributes": {"id": "db"}}]}`
+	read := `{"mode": "data", "type": "null_data_source", "name": "read", ` + provider + `, "instances": [{"schema_version": 0, "attributes": {"id": "r"}}]}`
+	files := map[string]string{
+		"a":     state("aaaa", 1, web+", "+read),
+		"b":     state("bbbb", 1, web2+", "+read+", "+db),
+		"b.old": state("bbbb", 0, db),
+	}
+	readers := func(names ...string) []NamedReader {
+		var rs []NamedReader
+		for _, name := range names {
+			rs = append(rs, NamedReader{Name: name, Reader: strings.NewReader(files[name])})
+		}
+		return rs
+	}
+	type row struct {
+		addr, file, status string
+		conflict           bool
+	}
+
+	tests := []struct {
+		name     string
+		opts     Options
+		listOpts ListOptions
+		files    []string
+		expect   []row
+	}{
+		{
+			name:  "all",
+			files: []string{"a", "b", "b.old"},
+			expect: []row{
+				{"data.null_data_source.read", "a", "current", false},
+				{"null_resource.web[0]", "a", "tainted", true},
+				{"null_resource.web[0]", "a", "deposed", true},
+				{"null_resource.web[1]", "a", "current", true},
+				{"data.null_data_source.read", "b", "current", false},
+				{"null_resource.db", "b", "current", false},
+				{"null_resource.web[2]", "b", "current", true},
+				// Superseded by b, so it's not merged
+				{"null_resource.db", "b.old", "current", false},
+			},
+		},
+		{
+			name:     "conflicts only, data sources kept",
+			opts:     Options{DataSources: "keep"},
+			listOpts: ListOptions{ConflictsOnly: true},
+			files:    []string{"a", "b"},
+			expect: []row{
+				{"data.null_data_source.read", "a", "current", true},
+				{"null_resource.web[0]", "a", "tainted", true},
+				{"null_resource.web[0]", "a", "deposed", true},
+				{"null_resource.web[1]", "a", "current", true},
+				{"data.null_data_source.read", "b", "current", true},
+				{"null_resource.web[2]", "b", "current", true},
+			},
+		},
+		{
+			name:     "address globs",
+			listOpts: ListOptions{Addresses: []string{`null_resource.web\[0\]`, "*.db"}},
+			files:    []string{"a", "b"},
+			expect: []row{
+				{"null_resource.web[0]", "a", "tainted", true},
+				{"null_resource.web[0]", "a", "deposed", true},
+				{"null_resource.db", "b", "current", false},
+			},
+		},
+		{
+			name:     "resource address glob",
+			listOpts: ListOptions{Addresses: []string{"null_resource.web"}},
+			files:    []string{"b"},
+			expect: []row{
+				{"null_resource.web[2]", "b", "current", false},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, report, err := List(nil, tt.opts, tt.listOpts, readers(tt.files...))
+			require.NoError(t, err)
+			var rows []row
+			for _, e := range entries {
+				rows = append(rows, row{e.Address, e.StateFile, e.Status, e.Conflict})
+				require.Equal(t, `provider["registry.terraform.io/hashicorp/null"]`, e.Provider)
+			}
+			require.Equal(t, tt.expect, rows)
+			if len(tt.files) == 3 {
+				require.Len(t, report.Superseded, 1)
+			}
+		})
+	}
+
+	entries, _, err := List(nil, Options{}, ListOptions{}, readers("a", "b"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, entries[1].ConflictsWith)
+	require.Equal(t, "00000001", entries[2].DeposedKey)
+	require.Equal(t, "list", entries[1].Each)
+
+	_, _, err = List(nil, Options{}, ListOptions{Addresses: []string{"null_resource.web["}}, readers("a"))
+	require.ErrorContains(t, err, `invalid address glob "null_resource.web["`)
+}
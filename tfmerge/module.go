@@ -0,0 +1,78 @@
+package tfmerge
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ------------------| Module: FNs |------------------
+
+// moduleNameRe matches a valid module name, i.e. a terraform identifier
+var moduleNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// validateModuleAddr checks that the module address is a chain of non-instanced module calls, e.g. "module.a.module.b".
+func validateModuleAddr(addr string) error {
+	parts := strings.Split(addr, ".")
+	if len(parts)%2 != 0 {
+		return fmt.Errorf("invalid module address %q", addr)
+	}
+	for i := 0; i < len(parts); i += 2 {
+		if parts[i] != "module" || !moduleNameRe.MatchString(parts[i+1]) {
+			return fmt.Errorf("invalid module address %q", addr)
+		}
+	}
+	return nil
+}
+
+// moduleName turns a string (e.g. a directory name) into a valid module name.
+func moduleName(s string) string {
+	name := []byte(s)
+	for i, c := range name {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 || !(name[0] >= 'A' && name[0] <= 'Z' || name[0] >= 'a' && name[0] <= 'z' || name[0] == '_') {
+		name = append([]byte{'_'}, name...)
+	}
+	return string(name)
+}
+
+// moveToModule moves all the resources of the decoded (v4) state file under the module address, e.g. "module.network".
+// The absolute addresses recorded in the state move along: the module of the resources, the instance dependencies and
+// the provider configurations of child modules. The provider configurations of the root module are kept, as a child
+// module inherits them.
+func moveToModule(thisState map[string]interface{}, module string) {
+	prefix := func(addr string) string {
+		if addr == "" {
+			return module
+		}
+		return module + "." + addr
+	}
+	resources, _ := thisState["resources"].([]interface{})
+	for _, r := range resources {
+		res, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		m, _ := res["module"].(string)
+		res["module"] = prefix(m)
+		if provider, ok := res["provider"].(string); ok && strings.HasPrefix(provider, "module.") {
+			res["provider"] = prefix(provider)
+		}
+		instances, _ := res["instances"].([]interface{})
+		for _, inst := range instances {
+			instance, ok := inst.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			dependencies, _ := instance["dependencies"].([]interface{})
+			for i, dep := range dependencies {
+				if s, ok := dep.(string); ok {
+					dependencies[i] = prefix(s)
+				}
+			}
+		}
+	}
+}
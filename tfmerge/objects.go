@@ -0,0 +1,108 @@
+package tfmerge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// ------------------| Duplicate Objects: FNs |------------------
+
+// defaultIdentityAttribute is the instance attribute identifying the real object managed by a resource instance,
+// unless overridden per resource type.
+const defaultIdentityAttribute = "id"
+
+// checkDuplicateObjects indexes the managed resource instances of the merged state by their identity attribute,
+// and reports the real objects that are owned by more than one address. It errors unless warnOnly is set.
+// The index is per resource type, as e.g. "aws_s3_bucket" and "aws_s3_bucket_versioning" share the bucket name as id.
+func checkDuplicateObjects(resources []Resource, identityAttributes map[string]string, warnOnly bool, report *Report) error {
+	type object struct{ typ, identity string }
+	owners := make(map[object][]string)
+	var objects []object
+
+	for _, res := range resources {
+		if res.Mode != string(tfjson.ManagedResourceMode) {
+			continue
+		}
+		attr := defaultIdentityAttribute
+		if v, ok := identityAttributes[res.Type]; ok {
+			attr = v
+		}
+		addr := resourceAddr(res.Module, res.Mode, res.Type, res.Name)
+		for _, inst := range res.Instances {
+			instance, ok := inst.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			// A deposed object is not the current object of its address
+			if _, ok := instance["deposed"]; ok {
+				continue
+			}
+			identity := instanceAttribute(instance, attr)
+			if identity == "" {
+				continue
+			}
+			obj := object{typ: res.Type, identity: identity}
+			if _, ok := owners[obj]; !ok {
+				objects = append(objects, obj)
+			}
+			owners[obj] = append(owners[obj], instanceAddr(addr, instance["index_key"]))
+		}
+	}
+
+	var dups []string
+	for _, obj := range objects {
+		addrs := owners[obj]
+		if len(addrs) < 2 {
+			continue
+		}
+		sort.Strings(addrs)
+		report.DuplicateObjects = append(report.DuplicateObjects, DuplicateObject{
+			Type:      obj.typ,
+			Identity:  obj.identity,
+			Addresses: addrs,
+		})
+		msg := fmt.Sprintf("%s %q is managed by multiple addresses: %s", obj.typ, obj.identity, strings.Join(addrs, ", "))
+		if warnOnly {
+			report.Warnings = append(report.Warnings, msg)
+			continue
+		}
+		dups = append(dups, msg)
+	}
+	if len(dups) != 0 {
+		return fmt.Errorf("the merged state has duplicate objects:\n%s", strings.Join(dups, "\n"))
+	}
+	return nil
+}
+
+// instanceAttribute returns the string value of the top level attribute of the instance, or empty if not set.
+// Both "attributes" and the legacy "attributes_flat" are looked up.
+func instanceAttribute(instance map[string]interface{}, attr string) string {
+	for _, key := range []string{"attributes", "attributes_flat"} {
+		attrs, ok := instance[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch v := attrs[attr].(type) {
+		case string:
+			return v
+		case float64, bool:
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+// instanceAddr returns the address of the resource instance, e.g. `null_resource.test["a"]`.
+func instanceAddr(resourceAddr string, indexKey interface{}) string {
+	switch key := indexKey.(type) {
+	case float64:
+		return fmt.Sprintf("%s[%d]", resourceAddr, int(key))
+	case string:
+		return fmt.Sprintf("%s[%q]", resourceAddr, key)
+	default:
+		return resourceAddr
+	}
+}
@@ -0,0 +1,55 @@
+package tfmerge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckDuplicateObjects(t *testing.T) {
+	const rgID = "/subscriptions/xxx/resourceGroups/rg"
+	resources := []Resource{
+		testResource("", "managed", "azurerm_resource_group", "a",
+			testInstance(rgID)),
+		testResource("module.other", "managed", "azurerm_resource_group", "b",
+			testInstance(rgID, "index_key", "x")),
+		// Data sources only read the object
+		testResource("", "data", "azurerm_resource_group", "a",
+			testInstance(rgID)),
+		// Different resource types can share the same id
+		testResource("", "managed", "azurerm_management_lock", "a",
+			testInstance(rgID)),
+		// Deposed objects are not the current objects
+		testResource("", "managed", "azurerm_resource_group", "c",
+			testInstance(rgID, "deposed", "00000001")),
+	}
+
+	var report Report
+	err := checkDuplicateObjects(resources, nil, false, &report)
+	require.ErrorContains(t, err, `azurerm_resource_group.a, module.other.azurerm_resource_group.b["x"]`)
+
+	report = Report{}
+	require.NoError(t, checkDuplicateObjects(resources, nil, true, &report))
+	require.Equal(t, []DuplicateObject{{
+		Type:      "azurerm_resource_group",
+		Identity:  rgID,
+		Addresses: []string{"azurerm_resource_group.a", `module.other.azurerm_resource_group.b["x"]`},
+	}}, report.DuplicateObjects)
+	require.Len(t, report.Warnings, 1)
+}
+
+func TestCheckDuplicateObjectsIdentityAttribute(t *testing.T) {
+	sameName := func(instance map[string]interface{}) map[string]interface{} {
+		instance["attributes"].(map[string]interface{})["name"] = "same"
+		return instance
+	}
+	resources := []Resource{
+		testResource("", "managed", "null_resource", "a", sameName(testInstance("1", "index_key", 0))),
+		testResource("", "managed", "null_resource", "b", sameName(testInstance("2"))),
+	}
+
+	var report Report
+	require.NoError(t, checkDuplicateObjects(resources, nil, false, &report))
+	err := checkDuplicateObjects(resources, map[string]string{"null_resource": "name"}, false, &report)
+	require.ErrorContains(t, err, "null_resource.a[0], null_resource.b")
+}
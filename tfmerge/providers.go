@@ -0,0 +1,136 @@
+package tfmerge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ------------------| Provider: FNs |------------------
+
+// defaultProviderRegistry is the registry host of the provider source addresses without one, e.g. "hashicorp/aws".
+const defaultProviderRegistry = "registry.terraform.io"
+
+// providerRef is a reference to a provider configuration, as recorded in the "provider" of a state resource,
+// e.g. `module.a.provider["registry.terraform.io/hashicorp/aws"].west`.
+type providerRef struct {
+	module string
+	source string
+	alias  string
+}
+
+// parseProviderRef parses a provider configuration reference.
+func parseProviderRef(s string) (providerRef, error) {
+	var ref providerRef
+	i := strings.Index(s, `provider["`)
+	if i < 0 {
+		return ref, fmt.Errorf("invalid provider reference %q", s)
+	}
+	if i > 0 {
+		if !strings.HasSuffix(s[:i], ".") {
+			return ref, fmt.Errorf("invalid provider reference %q", s)
+		}
+		ref.module = strings.TrimSuffix(s[:i], ".")
+	}
+	rest := s[i+len("provider["):]
+	end := strings.Index(rest, `"]`)
+	if end < 0 {
+		return ref, fmt.Errorf("invalid provider reference %q", s)
+	}
+	source, err := strconv.Unquote(rest[:end+1])
+	if err != nil {
+		return ref, fmt.Errorf("invalid provider reference %q: %v", s, err)
+	}
+	ref.source = normalizeProviderSource(source)
+	rest = rest[end+2:]
+	if rest != "" {
+		if !strings.HasPrefix(rest, ".") || len(rest) == 1 {
+			return ref, fmt.Errorf("invalid provider reference %q", s)
+		}
+		ref.alias = rest[1:]
+	}
+	return ref, nil
+}
+
+// String renders the provider configuration reference in the form recorded in the state.
+func (ref providerRef) String() string {
+	s := fmt.Sprintf("provider[%q]", ref.source)
+	if ref.module != "" {
+		s = ref.module + "." + s
+	}
+	if ref.alias != "" {
+		s += "." + ref.alias
+	}
+	return s
+}
+
+// normalizeProviderSource adds the default registry host to a provider source address without one.
+func normalizeProviderSource(source string) string {
+	if strings.Count(source, "/") == 1 {
+		return defaultProviderRegistry + "/" + source
+	}
+	return source
+}
+
+// providerMapper remaps the provider references of the merged resources.
+// A mapping is either between provider source addresses (e.g. "hashicorp/azurerm=myorg/azurerm"), which keeps the module
+// and alias of the references, or between provider configurations (e.g. `provider["hashicorp/aws"]=provider["hashicorp/aws"].west`),
+// which takes precedence and keeps the module of the references.
+type providerMapper struct {
+	sources map[string]string
+	configs map[providerRef]providerRef // Without module
+}
+
+// newProviderMapper parses the provider mappings, from -> to.
+func newProviderMapper(mappings map[string]string) (*providerMapper, error) {
+	mapper := &providerMapper{
+		sources: make(map[string]string),
+		configs: make(map[providerRef]providerRef),
+	}
+	for from, to := range mappings {
+		if strings.Contains(from, "provider[") {
+			fromRef, err := parseProviderRef(from)
+			if err != nil {
+				return nil, err
+			}
+			toRef, err := parseProviderRef(to)
+			if err != nil {
+				return nil, err
+			}
+			if fromRef.module != "" || toRef.module != "" {
+				return nil, fmt.Errorf("invalid provider mapping %s=%s: module is not allowed", from, to)
+			}
+			mapper.configs[fromRef] = toRef
+			continue
+		}
+		if strings.Contains(to, "provider[") || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid provider mapping %s=%s", from, to)
+		}
+		mapper.sources[normalizeProviderSource(from)] = normalizeProviderSource(to)
+	}
+	return mapper, nil
+}
+
+// apply returns the remapped provider reference. Without any mapping, the reference is returned as is.
+// A reference that can't be parsed is an error, as it can't be told whether a mapping applies to it.
+func (mapper *providerMapper) apply(provider string) (string, error) {
+	if mapper == nil || len(mapper.sources) == 0 && len(mapper.configs) == 0 {
+		return provider, nil
+	}
+	ref, err := parseProviderRef(provider)
+	if err != nil {
+		return "", fmt.Errorf("remapping the provider: %v", err)
+	}
+	module := ref.module
+	ref.module = ""
+	if to, ok := mapper.configs[ref]; ok {
+		to.module = module
+		return to.String(), nil
+	}
+	if to, ok := mapper.sources[ref.source]; ok {
+		ref.source = to
+		ref.module = module
+		return ref.String(), nil
+	}
+	return provider, nil
+}
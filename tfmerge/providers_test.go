@@ -0,0 +1,104 @@
+package tfmerge
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProviderRef(t *testing.T) {
+	refCases := []struct {
+		input    string
+		expect   providerRef
+		hasError bool
+	}{
+		{
+			input:  `provider["registry.terraform.io/hashicorp/aws"]`,
+			expect: providerRef{source: "registry.terraform.io/hashicorp/aws"},
+		},
+		{
+			input:  `module.a.module.b["x"].provider["registry.terraform.io/hashicorp/aws"].west`,
+			expect: providerRef{module: `module.a.module.b["x"]`, source: "registry.terraform.io/hashicorp/aws", alias: "west"},
+		},
+		{
+			input:  `provider["hashicorp/aws"]`,
+			expect: providerRef{source: "registry.terraform.io/hashicorp/aws"},
+		},
+		{input: "provider.aws", hasError: true},
+		{input: `provider["registry.terraform.io/hashicorp/aws"]west`, hasError: true},
+	}
+	for _, tt := range refCases {
+		t.Run(tt.input, func(t *testing.T) {
+			ref, err := parseProviderRef(tt.input)
+			if tt.hasError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, ref)
+		})
+	}
+}
+
+func TestProviderMapper(t *testing.T) {
+	mapper, err := newProviderMapper(map[string]string{
+		"hashicorp/azurerm":                                   "registry.terraform.io/myorg/azurerm",
+		"registry.terraform.io/hashicorp/null":                "registry.opentofu.org/hashicorp/null",
+		`provider["registry.terraform.io/hashicorp/aws"]`:     `provider["registry.terraform.io/hashicorp/aws"].west`,
+		`provider["registry.terraform.io/hashicorp/aws"].old`: `provider["registry.terraform.io/hashicorp/aws"]`,
+	})
+	require.NoError(t, err)
+
+	requireApply(t, mapper, `provider["registry.terraform.io/hashicorp/azurerm"].alt`, `provider["registry.terraform.io/myorg/azurerm"].alt`)
+	requireApply(t, mapper, `module.a.provider["registry.terraform.io/hashicorp/null"]`, `module.a.provider["registry.opentofu.org/hashicorp/null"]`)
+	requireApply(t, mapper, `module.a.provider["registry.terraform.io/hashicorp/aws"]`, `module.a.provider["registry.terraform.io/hashicorp/aws"].west`)
+	requireApply(t, mapper, `provider["registry.terraform.io/hashicorp/aws"].old`, `provider["registry.terraform.io/hashicorp/aws"]`)
+	requireApply(t, mapper, `provider["registry.terraform.io/hashicorp/aws"].east`, `provider["registry.terraform.io/hashicorp/aws"].east`)
+
+	_, err = mapper.apply("provider.aws")
+	require.ErrorContains(t, err, `invalid provider reference "provider.aws"`)
+
+	// No mapping
+	mapper, err = newProviderMapper(nil)
+	require.NoError(t, err)
+	requireApply(t, mapper, "provider.aws", "provider.aws")
+
+	_, err = newProviderMapper(map[string]string{`module.a.provider["hashicorp/aws"]`: `provider["hashicorp/aws"]`})
+	require.Error(t, err)
+	_, err = newProviderMapper(map[string]string{"hashicorp/aws": `provider["hashicorp/aws"]`})
+	require.Error(t, err)
+}
+
+func requireApply(t *testing.T, mapper *providerMapper, provider, expect string) {
+	t.Helper()
+	actual, err := mapper.apply(provider)
+	require.NoError(t, err)
+	require.Equal(t, expect, actual)
+}
+
+func TestMergeProviderMapLegacy(t *testing.T) {
+	initTest(t)
+	// The legacy provider references of terraform v0.12 are remapped like the others
+	b, _, err := MergeReaders(context.Background(), nil, Options{ProviderMap: map[string]string{"hashicorp/null": "myorg/null"}}, []NamedReader{{
+		Name:   "state",
+		Reader: strings.NewReader(`{"version": 4, "terraform_version": "0.12.31", "serial": 1, "lineage": "aaaa", "outputs": {}, "resources": [{"mode": "managed", "type": "null_resource", "name": "a", "provider": "module.x.provider.null.alt", "instances": []}]}`),
+	}})
+	require.NoError(t, err)
+	state, err := decodeState(b)
+	require.NoError(t, err)
+	require.Equal(t, `module.x.provider["registry.terraform.io/myorg/null"].alt`, state["resources"].([]interface{})[0].(map[string]interface{})["provider"])
+}
+
+func TestStateProviders(t *testing.T) {
+	state := State{Resources: []Resource{
+		{Provider: `provider["registry.terraform.io/hashicorp/null"]`},
+		{Provider: `module.x.provider["registry.terraform.io/hashicorp/aws"].west`},
+		{Provider: `provider["registry.terraform.io/hashicorp/null"]`},
+	}}
+	require.Equal(t, []string{
+		`module.x.provider["registry.terraform.io/hashicorp/aws"].west`,
+		`provider["registry.terraform.io/hashicorp/null"]`,
+	}, state.providers())
+}
@@ -0,0 +1,180 @@
+package tfmerge
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ------------------| Redact: FNs |------------------
+// A redacted state can be shared to debug a merge: the secrets are replaced, while the merge behaves the same.
+// Each redacted value is replaced by a keyed hash of it, so equal values stay equal (across all the states redacted
+// by the same Redactor) and the conflicts between the states are kept.
+// The redacted values are:
+//   - The attributes listed in the sensitive_attributes of an instance
+//   - The private data of an instance
+//   - The attributes matching the patterns, by their dotted path (e.g. "password", "tags.*", "*secret*")
+//   - The sensitive outputs
+
+// redactedPrefix marks a redacted value
+const redactedPrefix = "redacted:"
+
+// RedactOptions controls what Redactor redacts & how.
+type RedactOptions struct {
+	// Patterns are globs matched against the dotted path of the attributes, e.g. "*password*" or "ingress.*.cidr_blocks".
+	Patterns []string
+	// Key of the hashes. The states need the same key to keep the equality of their values, a random key is used if empty.
+	Key []byte
+}
+
+// Redactor redacts the secrets of state files.
+type Redactor struct {
+	patterns []string
+	key      []byte
+}
+
+// NewRedactor returns a Redactor, the states redacted by the same Redactor keep the equality of their values.
+func NewRedactor(opts RedactOptions) (*Redactor, error) {
+	for _, pattern := range opts.Patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	key := opts.Key
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &Redactor{patterns: opts.Patterns, key: key}, nil
+}
+
+// Redact returns the redacted state file, in the canonical format. Legacy (v3) state files are upgraded to v4.
+func (r *Redactor) Redact(b []byte) ([]byte, error) {
+	thisState, err := decodeState(b)
+	if err != nil {
+		return nil, err
+	}
+
+	resources, _ := thisState["resources"].([]interface{})
+	for _, res := range resources {
+		res, ok := res.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		instances, _ := res["instances"].([]interface{})
+		for _, inst := range instances {
+			if instance, ok := inst.(map[string]interface{}); ok {
+				r.redactInstance(instance)
+			}
+		}
+	}
+	outputs, _ := thisState["outputs"].(map[string]interface{})
+	for _, output := range outputs {
+		if output, ok := output.(map[string]interface{}); ok && output["sensitive"] == true {
+			output["value"] = r.hash(output["value"])
+		}
+	}
+
+	state, err := canonicalState(thisState)
+	if err != nil {
+		return nil, err
+	}
+	return marshalState(state)
+}
+
+func (r *Redactor) redactInstance(instance map[string]interface{}) {
+	if private, ok := instance["private"].(string); ok {
+		// Kept as base64, like the private data
+		instance["private"] = base64.StdEncoding.EncodeToString([]byte(r.hash(private).(string)))
+	}
+	if attrs, ok := instance["attributes"].(map[string]interface{}); ok {
+		sensitive, _ := instance["sensitive_attributes"].([]interface{})
+		for _, p := range sensitive {
+			steps, _ := p.([]interface{})
+			r.redactPath(attrs, steps)
+		}
+		r.redactPatterns(attrs, "")
+	}
+	if flat, ok := instance["attributes_flat"].(map[string]interface{}); ok {
+		for k, v := range flat {
+			if r.matches(k) {
+				flat[k] = r.hash(v)
+			}
+		}
+	}
+}
+
+// redactPath redacts the value at the path of a sensitive attribute, e.g. [{"type": "get_attr", "value": "password"}]
+func (r *Redactor) redactPath(v interface{}, steps []interface{}) interface{} {
+	if len(steps) == 0 {
+		return r.hash(v)
+	}
+	key := stepKey(steps[0])
+	switch v := v.(type) {
+	case map[string]interface{}:
+		k, ok := key.(string)
+		if _, exists := v[k]; ok && exists {
+			v[k] = r.redactPath(v[k], steps[1:])
+		}
+	case []interface{}:
+		if i, ok := key.(float64); ok && int(i) >= 0 && int(i) < len(v) {
+			v[int(i)] = r.redactPath(v[int(i)], steps[1:])
+		}
+	}
+	return v
+}
+
+// redactPatterns redacts the attributes matching the patterns, by their dotted path
+func (r *Redactor) redactPatterns(v interface{}, prefix string) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if r.matches(join(k)) {
+				v[k] = r.hash(child)
+				continue
+			}
+			r.redactPatterns(child, join(k))
+		}
+	case []interface{}:
+		for i, child := range v {
+			if r.matches(join(strconv.Itoa(i))) {
+				v[i] = r.hash(child)
+				continue
+			}
+			r.redactPatterns(child, join(strconv.Itoa(i)))
+		}
+	}
+}
+
+func (r *Redactor) matches(attrPath string) bool {
+	return matchAny(r.patterns, attrPath)
+}
+
+// hash replaces the value by its keyed hash, null stays null and a redacted value stays the same.
+func (r *Redactor) hash(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	if s, ok := v.(string); ok && strings.HasPrefix(s, redactedPrefix) {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write(b)
+	return redactedPrefix + hex.EncodeToString(mac.Sum(nil))[:32]
+}
@@ -0,0 +1,105 @@
+package tfmerge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedact(t *testing.T) {
+	state := func(password string) []byte {
+		return []byte(`{
+  "version": 4,
+  "serial": 1,
+  "lineage": "00000000-0000-0000-0000-000000000000",
+  "outputs": {
+    "password": {"value": "` + password + `", "type": "string", "sensitive": true},
+    "name": {"value": "db", "type": "string"}
+  },
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "db",
+      "name": "test",
+      "provider": "provider[\"registry.terraform.io/hashicorp/db\"]",
+      "instances": [
+        {
+          "schema_version": 0,
+          "attributes": {"id": "db-1", "password": "` + password + `", "tags": {"secret": "s3cr3t", "owner": "me"}, "users": [{"token": "t0k3n"}]},
+          "sensitive_attributes": [[{"type": "get_attr", "value": "password"}], [{"type": "get_attr", "value": "users"}, {"type": "index", "value": {"value": 0, "type": "number"}}]],
+          "private": "c2VjcmV0"
+        }
+      ]
+    }
+  ]
+}`)
+	}
+	attrs := func(b []byte) (map[string]interface{}, map[string]interface{}) {
+		var m map[string]interface{}
+		require.NoError(t, json.Unmarshal(b, &m))
+		instance := m["resources"].([]interface{})[0].(map[string]interface{})["instances"].([]interface{})[0].(map[string]interface{})
+		return m, instance
+	}
+
+	r, err := NewRedactor(RedactOptions{Patterns: []string{"tags.secret"}})
+	require.NoError(t, err)
+	b1, err := r.Redact(state("hunter2"))
+	require.NoError(t, err)
+	b2, err := r.Redact(state("hunter2"))
+	require.NoError(t, err)
+	b3, err := r.Redact(state("hunter3"))
+	require.NoError(t, err)
+
+	for _, secret := range []string{"hunter2", "s3cr3t", "t0k3n", "c2VjcmV0"} {
+		require.NotContains(t, string(b1), secret)
+	}
+	// Equal values stay equal, different ones stay different
+	require.Equal(t, string(b1), string(b2))
+	m1, i1 := attrs(b1)
+	m3, i3 := attrs(b3)
+	require.NotEqual(t, i1["attributes"].(map[string]interface{})["password"], i3["attributes"].(map[string]interface{})["password"])
+	require.Equal(t, i1["private"], i3["private"])
+	require.NotEqual(t, m1["outputs"].(map[string]interface{})["password"], m3["outputs"].(map[string]interface{})["password"])
+
+	// The rest is kept
+	a1 := i1["attributes"].(map[string]interface{})
+	require.Equal(t, "db-1", a1["id"])
+	require.Equal(t, "me", a1["tags"].(map[string]interface{})["owner"])
+	require.Equal(t, "db", m1["outputs"].(map[string]interface{})["name"].(map[string]interface{})["value"])
+
+	_, err = NewRedactor(RedactOptions{Patterns: []string{"["}})
+	require.Error(t, err)
+}
+
+// The redacted states still reproduce the merge conflicts
+func TestRedactConflicts(t *testing.T) {
+	initTest(t)
+	for _, tt := range cases {
+		if tt.baseState != "" {
+			continue
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRedactor(RedactOptions{Patterns: []string{"*"}})
+			require.NoError(t, err)
+			stateFiles, _ := testFixture(t, tt.dir)
+			var readers []NamedReader
+			for _, stateFile := range stateFiles {
+				b, err := os.ReadFile(stateFile)
+				require.NoError(t, err)
+				b, err = r.Redact(b)
+				require.NoError(t, err)
+				readers = append(readers, NamedReader{Name: stateFile, Reader: bytes.NewReader(b)})
+			}
+			_, _, err = MergeReaders(context.Background(), nil, Options{}, readers)
+			if tt.hasError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package tfmerge
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ------------------| Report: FNs |------------------
+
+// String renders the report for humans.
+func (report *Report) String() string {
+	var sb strings.Builder
+	for _, w := range report.Warnings {
+		fmt.Fprintf(&sb, "Warning: %s\n", w)
+	}
+	if len(report.Superseded) != 0 {
+		sb.WriteString("Superseded state files:\n")
+		for _, s := range report.Superseded {
+			fmt.Fprintf(&sb, "  - %s (serial %d) by %s (serial %d), lineage %s\n", s.StateFile, s.Serial, s.By, s.BySerial, s.Lineage)
+		}
+	}
+	if len(report.Providers) != 0 {
+		sb.WriteString("Provider configurations required by the merged state:\n")
+		for _, p := range report.Providers {
+			fmt.Fprintf(&sb, "  - %s\n", p)
+		}
+	}
+	return sb.String()
+}
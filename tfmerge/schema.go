@@ -0,0 +1,70 @@
+package tfmerge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ------------------| Schema Version: FNs |------------------
+
+// checkSchemaVersions detects the resource types whose instances have different schema versions across the state files,
+// which happens when the state files are written with different provider versions. Each of them is recorded in the report.
+func checkSchemaVersions(inputs []stateInput, report *Report) {
+	versions := make(map[string]map[uint64][]string) // type -> schema version -> state files
+	var types []string
+	for _, input := range inputs {
+		resources, _ := input.state["resources"].([]interface{})
+		for _, r := range resources {
+			res, ok := r.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			typ, _ := res["type"].(string)
+			instances, _ := res["instances"].([]interface{})
+			for _, inst := range instances {
+				instance, ok := inst.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if _, ok := versions[typ]; !ok {
+					versions[typ] = make(map[uint64][]string)
+					types = append(types, typ)
+				}
+				sv := instanceSchemaVersion(instance)
+				if files := versions[typ][sv]; len(files) == 0 || files[len(files)-1] != input.path {
+					versions[typ][sv] = append(files, input.path)
+				}
+			}
+		}
+	}
+
+	sort.Strings(types)
+	for _, typ := range types {
+		if len(versions[typ]) < 2 {
+			continue
+		}
+		mismatch := SchemaVersionMismatch{Type: typ, StateFiles: versions[typ]}
+		report.SchemaVersionMismatches = append(report.SchemaVersionMismatches, mismatch)
+		report.Warnings = append(report.Warnings, fmt.Sprintf("resource type %s has different schema versions across the state files: %s", typ, mismatch))
+	}
+}
+
+// String renders the schema versions with their state files, e.g. "0 (state1, state2), 1 (state3)".
+func (mismatch SchemaVersionMismatch) String() string {
+	var svs []uint64
+	for sv := range mismatch.StateFiles {
+		svs = append(svs, sv)
+	}
+	sort.Slice(svs, func(i, j int) bool { return svs[i] < svs[j] })
+	var parts []string
+	for _, sv := range svs {
+		parts = append(parts, fmt.Sprintf("%d (%s)", sv, strings.Join(mismatch.StateFiles[sv], ", ")))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func instanceSchemaVersion(instance map[string]interface{}) uint64 {
+	sv, _ := instance["schema_version"].(float64)
+	return uint64(sv)
+}
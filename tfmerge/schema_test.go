@@ -0,0 +1,53 @@
+package tfmerge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSchemaVersions(t *testing.T) {
+	inputs := []stateInput{
+		testInput("state1", "", 0, testResource("", "managed", "azurerm_linux_web_app", "test",
+			testInstance("0", "index_key", 0, "schema_version", 0),
+			testInstance("1", "index_key", 1, "schema_version", 0))),
+		testInput("state2", "", 0, testResource("", "managed", "azurerm_linux_web_app", "test",
+			testInstance("0", "index_key", 0, "schema_version", 1))),
+		testInput("state3", "", 0, testResource("", "managed", "null_resource", "test",
+			testInstance("0", "index_key", 0, "schema_version", 0))),
+		testInput("state4", "", 0, testResource("", "managed", "null_resource", "test",
+			testInstance("0", "index_key", 0, "schema_version", 0))),
+	}
+
+	var report Report
+	checkSchemaVersions(inputs, &report)
+	require.Equal(t, []SchemaVersionMismatch{{
+		Type:       "azurerm_linux_web_app",
+		StateFiles: map[uint64][]string{0: {"state1"}, 1: {"state2"}},
+	}}, report.SchemaVersionMismatches)
+	require.Equal(t, []string{"resource type azurerm_linux_web_app has different schema versions across the state files: 0 (state1), 1 (state2)"}, report.Warnings)
+}
+
+func TestMergeInstances(t *testing.T) {
+	res := Resource{Mode: "managed", Type: "null_resource", Name: "test", Instances: []interface{}{
+		testInstance("0", "index_key", 0, "schema_version", 0),
+	}}
+
+	// Identical instances are merged, new ones are added
+	require.NoError(t, res.mergeInstances(Resource{Instances: []interface{}{
+		testInstance("0", "index_key", 0, "schema_version", 0),
+		testInstance("1", "index_key", 1, "schema_version", 0),
+	}}, &Report{}))
+	require.Len(t, res.Instances, 2)
+
+	// The same instance must not differ
+	require.ErrorContains(t, res.mergeInstances(Resource{Instances: []interface{}{
+		testInstance("2", "index_key", 1, "schema_version", 0),
+	}}, &Report{}), "null_resource.test[1]")
+
+	// Instances of different schema versions are never combined
+	require.ErrorContains(t, res.mergeInstances(Resource{Instances: []interface{}{
+		testInstance("2", "index_key", 2, "schema_version", 1),
+	}}, &Report{}), "schema versions")
+	require.Len(t, res.Instances, 2)
+}
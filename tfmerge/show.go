@@ -0,0 +1,222 @@
+package tfmerge
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// ------------------| Show JSON: FNs |------------------
+// A state file can be shown in the format of `terraform show -json`, e.g. for policy tools like OPA to consume it
+// without terraform. The show-json document is built from the state file alone:
+//   - The child modules are nested under their parent module, like terraform does
+//   - The sensitive_attributes of an instance become its sensitive_values
+//   - The check results are left out, as their show-json format needs the configuration
+
+// showFormatVersion is the format version of the show-json document
+const showFormatVersion = "1.0"
+
+// showState is the `terraform show -json` document of a state
+type showState struct {
+	FormatVersion    string       `json:"format_version"`
+	TerraformVersion string       `json:"terraform_version,omitempty"`
+	Values           *StateValues `json:"values,omitempty"`
+}
+
+// ShowJSON returns the state file in the format of `terraform show -json`. Legacy (v3) state files are upgraded to v4.
+func ShowJSON(b []byte) ([]byte, error) {
+	thisState, err := decodeState(b)
+	if err != nil {
+		return nil, err
+	}
+	// The deposed objects follow the current object of their instance
+	state, err := canonicalState(thisState)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := state.showValues()
+	if err != nil {
+		return nil, err
+	}
+	out, err := json.Marshal(&showState{
+		FormatVersion:    showFormatVersion,
+		TerraformVersion: state.TerraformVersion,
+		Values:           values,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+func (state *State) showValues() (*StateValues, error) {
+	values := &StateValues{RootModule: &StateModule{}}
+	if len(state.Outputs) != 0 {
+		b, err := json.Marshal(state.Outputs)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &values.Outputs); err != nil {
+			return nil, fmt.Errorf("reading the outputs: %v", err)
+		}
+	}
+
+	modules := map[string]*tfjson.StateModule{"": (*tfjson.StateModule)(values.RootModule)}
+	// module returns the module of the address, adding it (and its missing ancestors) to the tree
+	var module func(addr string) *tfjson.StateModule
+	module = func(addr string) *tfjson.StateModule {
+		if mod, ok := modules[addr]; ok {
+			return mod
+		}
+		calls := splitModuleAddr(addr)
+		parent := module(strings.Join(calls[:len(calls)-1], "."))
+		mod := &tfjson.StateModule{Address: addr}
+		parent.ChildModules = append(parent.ChildModules, mod)
+		modules[addr] = mod
+		return mod
+	}
+
+	for _, res := range state.Resources {
+		mod := module(res.Module)
+		addr := resourceAddr(res.Module, res.Mode, res.Type, res.Name)
+		ref, err := parseProviderRef(res.Provider)
+		if err != nil {
+			return nil, fmt.Errorf("resource %s: %v", addr, err)
+		}
+		for _, inst := range res.Instances {
+			instance, ok := inst.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			sensitive, err := json.Marshal(sensitiveValues(instance))
+			if err != nil {
+				return nil, err
+			}
+			attrs, _ := instance["attributes"].(map[string]interface{})
+			deposed, _ := instance["deposed"].(string)
+			var dependsOn []string
+			dependencies, _ := instance["dependencies"].([]interface{})
+			for _, dep := range dependencies {
+				if dep, ok := dep.(string); ok {
+					dependsOn = append(dependsOn, dep)
+				}
+			}
+			mod.Resources = append(mod.Resources, &tfjson.StateResource{
+				Address:         instanceAddr(addr, instance["index_key"]),
+				Mode:            tfjson.ResourceMode(res.Mode),
+				Type:            res.Type,
+				Name:            res.Name,
+				Index:           instance["index_key"],
+				ProviderName:    ref.source,
+				SchemaVersion:   instanceSchemaVersion(instance),
+				AttributeValues: attrs,
+				SensitiveValues: sensitive,
+				DependsOn:       dependsOn,
+				Tainted:         isTainted(instance),
+				DeposedKey:      deposed,
+			})
+		}
+	}
+
+	// Like terraform, the resources & child modules are in the order of their address
+	for _, mod := range modules {
+		sort.SliceStable(mod.Resources, func(i, j int) bool {
+			return mod.Resources[i].Address < mod.Resources[j].Address
+		})
+		sort.SliceStable(mod.ChildModules, func(i, j int) bool {
+			return mod.ChildModules[i].Address < mod.ChildModules[j].Address
+		})
+	}
+	return values, nil
+}
+
+// splitModuleAddr splits the module address into its module calls, e.g. `module.a["x"].module.b` into `module.a["x"]` and `module.b`.
+// The dots within the index keys don't split.
+func splitModuleAddr(addr string) []string {
+	var calls []string
+	start, quoted, escaped := 0, false, false
+	for i := 0; i < len(addr); i++ {
+		c := addr[i]
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == '.' && strings.HasPrefix(addr[i+1:], "module."):
+			calls = append(calls, addr[start:i])
+			start = i + 1
+		}
+	}
+	return append(calls, addr[start:])
+}
+
+// sensitiveValues returns the sensitive_values of the instance: the shape of its attributes where the sensitive ones are true.
+// Like terraform, the non-sensitive attributes of objects are left out, while the elements of lists are false.
+func sensitiveValues(instance map[string]interface{}) interface{} {
+	var paths [][]interface{}
+	sensitive, _ := instance["sensitive_attributes"].([]interface{})
+	for _, p := range sensitive {
+		if steps, ok := p.([]interface{}); ok {
+			paths = append(paths, steps)
+		}
+	}
+	attrs, _ := instance["attributes"].(map[string]interface{})
+	if attrs == nil {
+		return map[string]interface{}{}
+	}
+	return sensitiveAsBool(attrs, paths)
+}
+
+func sensitiveAsBool(v interface{}, paths [][]interface{}) interface{} {
+	for _, steps := range paths {
+		if len(steps) == 0 {
+			return true
+		}
+	}
+	// next returns the rest of the paths going through the key
+	next := func(key interface{}) [][]interface{} {
+		var rest [][]interface{}
+		for _, steps := range paths {
+			if stepKey(steps[0]) == key {
+				rest = append(rest, steps[1:])
+			}
+		}
+		return rest
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		obj := map[string]interface{}{}
+		for k, child := range v {
+			if s := sensitiveAsBool(child, next(k)); s != false {
+				obj[k] = s
+			}
+		}
+		return obj
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for i, child := range v {
+			list = append(list, sensitiveAsBool(child, next(float64(i))))
+		}
+		return list
+	}
+	return false
+}
+
+// stepKey returns the attribute name or index key of a step of a sensitive attribute path,
+// e.g. {"type": "get_attr", "value": "password"} or {"type": "index", "value": {"value": 0, "type": "number"}}
+func stepKey(step interface{}) interface{} {
+	s, _ := step.(map[string]interface{})
+	key := s["value"]
+	if s["type"] == "index" {
+		if k, ok := key.(map[string]interface{}); ok {
+			key = k["value"]
+		}
+	}
+	return key
+}
@@ -0,0 +1,187 @@
+package tfmerge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShowJSON(t *testing.T) {
+	state := []byte(`{
+  "version": 4,
+  "terraform_version": "1.5.7",
+  "serial": 3,
+  "lineage": "00000000-0000-0000-0000-000000000000",
+  "outputs": {
+    "name": {"value": "db", "type": "string"},
+    "password": {"value": "hunter2", "type": "string", "sensitive": true}
+  },
+  "resources": [
+    {
+      "module": "module.a[\"x.y\"].module.b",
+      "mode": "managed",
+      "type": "null_resource",
+      "name": "nested",
+      "provider": "module.a[\"x.y\"].provider[\"registry.terraform.io/hashicorp/null\"]",
+      "instances": [
+        {"schema_version": 0, "attributes": {"id": "1"}, "sensitive_attributes": []}
+      ]
+    },
+    {
+      "mode": "data",
+      "type": "a_db",
+      "name": "read",
+      "provider": "provider[\"registry.terraform.io/hashicorp/db\"]",
+      "instances": [
+        {"schema_version": 0, "attributes": {"id": "r"}, "sensitive_attributes": []}
+      ]
+    },
+    {
+      "mode": "managed",
+      "type": "a_db",
+      "name": "test",
+      "each": "map",
+      "provider": "provider[\"hashicorp/db\"].west",
+      "instances": [
+        {
+          "index_key": "b",
+          "status": "tainted",
+          "schema_version": 2,
+          "attributes": {"id": "db-b", "password": "hunter2", "tags": {"owner": "me"}, "users": [{"token": "t0k3n"}, {"token": null}]},
+          "sensitive_attributes": [[{"type": "get_attr", "value": "password"}], [{"type": "get_attr", "value": "users"}, {"type": "index", "value": {"value": 0, "type": "number"}}, {"type": "get_attr", "value": "token"}]],
+          "private": "c2VjcmV0",
+          "dependencies": ["data.a_db.read"]
+        },
+        {
+          "index_key": "b",
+          "deposed": "00000001",
+          "schema_version": 2,
+          "attributes": {"id": "db-old"},
+          "sensitive_attributes": []
+        }
+      ]
+    }
+  ],
+  "check_results": null
+}`)
+
+	b, err := ShowJSON(state)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+  "format_version": "1.0",
+  "terraform_version": "1.5.7",
+  "values": {
+    "outputs": {
+      "name": {"sensitive": false, "value": "db", "type": "string"},
+      "password": {"sensitive": true, "value": "hunter2", "type": "string"}
+    },
+    "root_module": {
+      "resources": [
+        {
+          "address": "a_db.test[\"b\"]",
+          "mode": "managed",
+          "type": "a_db",
+          "name": "test",
+          "index": "b",
+          "provider_name": "registry.terraform.io/hashicorp/db",
+          "schema_version": 2,
+          "values": {"id": "db-b", "password": "hunter2", "tags": {"owner": "me"}, "users": [{"token": "t0k3n"}, {"token": null}]},
+          "sensitive_values": {"password": true, "tags": {}, "users": [{"token": true}, {}]},
+          "depends_on": ["data.a_db.read"],
+          "tainted": true
+        },
+        {
+          "address": "a_db.test[\"b\"]",
+          "mode": "managed",
+          "type": "a_db",
+          "name": "test",
+          "index": "b",
+          "provider_name": "registry.terraform.io/hashicorp/db",
+          "schema_version": 2,
+          "values": {"id": "db-old"},
+          "sensitive_values": {},
+          "deposed_key": "00000001"
+        },
+        {
+          "address": "data.a_db.read",
+          "mode": "data",
+          "type": "a_db",
+          "name": "read",
+          "provider_name": "registry.terraform.io/hashicorp/db",
+          "schema_version": 0,
+          "values": {"id": "r"},
+          "sensitive_values": {}
+        }
+      ],
+      "child_modules": [
+        {
+          "address": "module.a[\"x.y\"]",
+          "child_modules": [
+            {
+              "resources": [
+                {
+                  "address": "module.a[\"x.y\"].module.b.null_resource.nested",
+                  "mode": "managed",
+                  "type": "null_resource",
+                  "name": "nested",
+                  "provider_name": "registry.terraform.io/hashicorp/null",
+                  "schema_version": 0,
+                  "values": {"id": "1"},
+                  "sensitive_values": {}
+                }
+              ],
+              "address": "module.a[\"x.y\"].module.b"
+            }
+          ]
+        }
+      ]
+    }
+  }
+}`, string(b))
+
+	// An empty state still has its root module
+	b, err = ShowJSON([]byte(`{"version": 4, "serial": 1, "outputs": {}, "resources": []}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"format_version": "1.0", "values": {"root_module": {}}}`, string(b))
+}
+
+func TestShowJSONLegacyProviders(t *testing.T) {
+	// Written by terraform v0.12, with the legacy provider references
+	b, err := ShowJSON([]byte(`{
+  "version": 4,
+  "terraform_version": "0.12.31",
+  "serial": 1,
+  "lineage": "aaaa",
+  "outputs": {},
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "null_resource",
+      "name": "test",
+      "provider": "provider.null",
+      "instances": [{"schema_version": 0, "attributes": {"id": "1"}}]
+    }
+  ]
+}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+  "format_version": "1.0",
+  "terraform_version": "0.12.31",
+  "values": {
+    "root_module": {
+      "resources": [
+        {
+          "address": "null_resource.test",
+          "mode": "managed",
+          "type": "null_resource",
+          "name": "test",
+          "provider_name": "registry.terraform.io/hashicorp/null",
+          "schema_version": 0,
+          "values": {"id": "1"},
+          "sensitive_values": {}
+        }
+      ]
+    }
+  }
+}`, string(b))
+}
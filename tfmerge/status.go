@@ -0,0 +1,103 @@
+package tfmerge
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ------------------| Instance Status: FNs |------------------
+
+// instanceKey identifies an instance object within its resource: the current object of an instance has no deposed key.
+type instanceKey struct {
+	index   interface{} // nil, float64 or string
+	deposed string
+}
+
+func keyOf(instance map[string]interface{}) instanceKey {
+	deposed, _ := instance["deposed"].(string)
+	return instanceKey{index: instance["index_key"], deposed: deposed}
+}
+
+func isTainted(instance map[string]interface{}) bool {
+	return instance["status"] == "tainted"
+}
+
+func isDeposed(instance map[string]interface{}) bool {
+	_, ok := instance["deposed"]
+	return ok
+}
+
+// resolveInstances resolves the instances of another occurance of the same resource against this one.
+// If preferOther, the other occurance replaces this one (the "overwrite" resolution), otherwise this one is kept.
+// Either way, a tainted instance never beats a clean instance of the same key.
+func (res *Resource) resolveInstances(other Resource, preferOther bool, report *Report) {
+	winner, loser := res.Instances, other.Instances
+	if preferOther {
+		winner, loser = other.Instances, res.Instances
+	}
+	clean := make(map[instanceKey]map[string]interface{})
+	for _, inst := range loser {
+		if instance, ok := inst.(map[string]interface{}); ok && !isTainted(instance) {
+			clean[keyOf(instance)] = instance
+		}
+	}
+
+	addr := resourceAddr(res.Module, res.Mode, res.Type, res.Name)
+	var instances []interface{}
+	for _, inst := range winner {
+		instance, ok := inst.(map[string]interface{})
+		if ok && isTainted(instance) {
+			if c, ok := clean[keyOf(instance)]; ok {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("instance %s is tainted in one of the state files, keeping the clean one", instanceAddr(addr, instance["index_key"])))
+				instances = append(instances, c)
+				continue
+			}
+		}
+		instances = append(instances, inst)
+	}
+
+	if preferOther {
+		*res = other
+	}
+	res.Instances = instances
+}
+
+// dropDeposed returns the instances without the deposed objects.
+func dropDeposed(instances []interface{}) []interface{} {
+	var current []interface{}
+	for _, inst := range instances {
+		if instance, ok := inst.(map[string]interface{}); ok && isDeposed(instance) {
+			continue
+		}
+		current = append(current, inst)
+	}
+	return current
+}
+
+// checkDeposed errors if any of the state files contains deposed objects.
+func checkDeposed(inputs []stateInput) error {
+	var found []string
+	for _, input := range inputs {
+		resources, _ := input.state["resources"].([]interface{})
+		for _, r := range resources {
+			res, ok := r.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			module, _ := res["module"].(string)
+			mode, _ := res["mode"].(string)
+			typ, _ := res["type"].(string)
+			name, _ := res["name"].(string)
+			instances, _ := res["instances"].([]interface{})
+			for _, inst := range instances {
+				if instance, ok := inst.(map[string]interface{}); ok && isDeposed(instance) {
+					found = append(found, fmt.Sprintf("%s (deposed %v) in %s", instanceAddr(resourceAddr(module, mode, typ, name), instance["index_key"]), instance["deposed"], input.path))
+				}
+			}
+		}
+	}
+	if len(found) != 0 {
+		return fmt.Errorf("refusing to merge deposed objects, apply or drop them first:\n%s", strings.Join(found, "\n"))
+	}
+	return nil
+}
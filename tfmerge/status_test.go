@@ -0,0 +1,65 @@
+package tfmerge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func instanceIDs(res Resource) []string {
+	var ids []string
+	for _, inst := range res.Instances {
+		ids = append(ids, instanceAttribute(inst.(map[string]interface{}), "id"))
+	}
+	return ids
+}
+
+func TestResolveInstances(t *testing.T) {
+	existing := func() Resource {
+		return Resource{Mode: "managed", Type: "null_resource", Name: "test", Provider: "old", Instances: []interface{}{
+			testInstance("a0", "index_key", 0),
+			testInstance("a1", "index_key", 1, "status", "tainted"),
+		}}
+	}
+	incoming := Resource{Mode: "managed", Type: "null_resource", Name: "test", Provider: "new", Instances: []interface{}{
+		testInstance("b0", "index_key", 0, "status", "tainted"),
+		testInstance("b1", "index_key", 1),
+	}}
+
+	// skip: the existing one is kept, except for its tainted instances
+	res := existing()
+	var report Report
+	res.resolveInstances(incoming, false, &report)
+	require.Equal(t, "old", res.Provider)
+	require.Equal(t, []string{"a0", "b1"}, instanceIDs(res))
+	require.Len(t, report.Warnings, 1)
+
+	// overwrite: the incoming one is taken, except for its tainted instances
+	res = existing()
+	res.resolveInstances(incoming, true, &report)
+	require.Equal(t, "new", res.Provider)
+	require.Equal(t, []string{"a0", "b1"}, instanceIDs(res))
+}
+
+func TestMergeInstancesTainted(t *testing.T) {
+	res := Resource{Mode: "managed", Type: "null_resource", Name: "test", Instances: []interface{}{
+		testInstance("a0", "index_key", 0, "status", "tainted"),
+		testInstance("a1", "index_key", 1),
+	}}
+	require.NoError(t, res.mergeInstances(Resource{Instances: []interface{}{
+		testInstance("b0", "index_key", 0),
+		testInstance("b1", "index_key", 1, "status", "tainted"),
+	}}, &Report{}))
+	require.Equal(t, []string{"b0", "a1"}, instanceIDs(res))
+}
+
+func TestDeposed(t *testing.T) {
+	res := testResource("", "managed", "null_resource", "test",
+		testInstance("current"),
+		testInstance("old", "deposed", "00000001"),
+	)
+	require.Len(t, dropDeposed(res.Instances), 1)
+
+	inputs := []stateInput{testInput("state1", "", 0, res)}
+	require.ErrorContains(t, checkDeposed(inputs), "null_resource.test (deposed 00000001) in state1")
+}
@@ -4,12 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"os"
-	"path/filepath"
-	"strings"
+	"reflect"
+	"sort"
 
+	"filippo.io/age"
 	"github.com/hashicorp/go-multierror"
-	"github.com/hashicorp/terraform-exec/tfexec"
+	"github.com/hashicorp/go-version"
 	tfjson "github.com/hashicorp/terraform-json"
 )
 
@@ -20,42 +23,98 @@ import (
 // ------------------| MAIN PROGRAM |------------------
 
 // Merge merges the state files to the base state. If there is any resource address conflict, it will error.
-// pulledState can be nil to indicate no base state file.
-func Merge(ctx context.Context, tf *tfexec.Terraform, pulledState []byte, resolution string, stateFiles ...string) ([]byte, error) {
+// pulledState can be nil to indicate no base state file. Otherwise, its lineage is kept and its serial is incremented.
+// The state files are read directly, no terraform executable is needed.
+func Merge(ctx context.Context, pulledState []byte, opts Options, stateFiles ...string) ([]byte, error) {
+	out, _, err := MergeWithReport(ctx, pulledState, opts, stateFiles...)
+	return out, err
+}
+
+// MergeWithReport is like Merge, but also returns a report of what has been done to the state files, e.g. the superseded ones.
+func MergeWithReport(ctx context.Context, pulledState []byte, opts Options, stateFiles ...string) ([]byte, *Report, error) {
+	var readers []NamedReader
+	for _, stateFile := range stateFiles {
+		f, err := os.Open(stateFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		readers = append(readers, NamedReader{Name: stateFile, Reader: f})
+	}
+	return MergeReaders(ctx, pulledState, opts, readers)
+}
+
+// MergeReaders is like MergeWithReport, but reads the state files from the readers, e.g. stdin or the output of another command.
+// The name of a reader is how it is referred to in errors and the report.
+func MergeReaders(ctx context.Context, pulledState []byte, opts Options, stateFiles []NamedReader) ([]byte, *Report, error) {
 	// --------------------| FUNCLOGIC |--------------------
 	// 1. Create a objects to modify
 	// 		- finalState : State
-	// 		- finalStateValues : StateValues
-	// 		- finalStateModule : StateModule
 	// 		- stateLedger : ledger
-	// 2. Init() finalState w/ first StateFiles Version info
-	// 3. Loop through StateFiles (string) & ShowStateFile()
-	// 		4. Merge each resulting stateFile into finalStateModule (inside loop)
-	// 5. Construct the whole finalState object using
-	// 		- finalStateModule
-	// 		- finalStateValues
-	// 6. Return all resources as []byte using json.Marshal(finalState)
+	// 		- report : Report
+	// 2. Init() finalState
+	// 3. Read & decode the base state & all StateFiles, then group them by lineage
+	// 		- Only the highest serial StateFile of a lineage is kept (or error if opts.StrictLineage)
+	// 		- Report the resource types having different schema versions across StateFiles
+	// 		- Refuse StateFiles containing deposed objects if opts.Deposed is "error"
+	// 4. Loop through StateFiles (the base state first) & build their module tree
+	// 		- Refuse StateFiles written by a terraform newer than opts.MaxTerraformVersion
+	// 		- Keep the highest terraform_version among all StateFiles
+	// 		5. Merge each resulting stateFile into finalStateModule (inside loop)
+	// 		- Merge the outputs of the stateFiles, with the same resolution as the resources
+	// 		- Keep the lineage of the base state & increment the highest serial of its lineage
+	// 6. Ensure no real object is managed by multiple addresses in finalState
+	// 		- Report the provider configurations needed by finalState
+	// 7. Return all resources as []byte using marshalState(finalState), i.e. terraform's layout with sorted resources
 	//
 	// --------------------| VARIABLES |--------------------
 	var result *multierror.Error
 	var finalState State
-	// var thisState State
-	var thisState map[string]interface{}
-	var finalStateValues StateValues
-	// var finalStateOutput tfjson.StateOutput
-	var finalStateModule StateModule
-	m := make(map[string]interface{})
 	var stateLedger ledger
+	var report Report
+	var inputs []stateInput
+	var baseState map[string]interface{}
 	var session = session{
-		ctx: &ctx,
-		tf:  tf,
+		ctx:    &ctx,
+		opts:   opts,
+		report: &report,
 	}
+	var maxVersion *version.Version
 	// --------------------| CONSTRCTR |--------------------
-	finalState.init(session, stateFiles[0])
+	if opts.MaxTerraformVersion != "" {
+		v, err := version.NewVersion(opts.MaxTerraformVersion)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing the maximum terraform version: %v", err)
+		}
+		maxVersion = v
+	}
+	switch opts.DuplicateObjects {
+	case "", "error", "warn":
+	default:
+		return nil, nil, fmt.Errorf("unknown duplicate objects policy %q", opts.DuplicateObjects)
+	}
+	switch opts.DataSources {
+	case "", "keep", "drop", "dedupe":
+	default:
+		return nil, nil, fmt.Errorf("unknown data sources policy %q", opts.DataSources)
+	}
+	switch opts.Deposed {
+	case "", "keep", "drop", "error":
+	default:
+		return nil, nil, fmt.Errorf("unknown deposed objects policy %q", opts.Deposed)
+	}
+	providers, err := newProviderMapper(opts.ProviderMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	session.providers = providers
+	finalState.init()
+	finalState.Outputs = make(map[string]interface{})
 	stateLedger.init()
 
 	// --------------------| STATEFILE |--------------------
 	// (src: https://pkg.go.dev/github.com/hashicorp/terraform-json)
+	// The module tree of each stateFile is built by stateModule() in the shape of `terraform show -json`:
 	// statefile : tfjson.State
 	// ├── FormatVersion : string
 	// ├── TerraformVersion : string
@@ -63,7 +122,7 @@ func Merge(ctx context.Context, tf *tfexec.Terraform, pulledState []byte, resolu
 	// |	├── Address : tfjson.CheckStaticAddress
 	// |	├── Status : tfjson.CheckStatus
 	// |	└── Instances : []tfjson.CheckResultDynamic
-	// └── Values : StateValues
+	// └── Values : tfjson.StateValues
 	// 		├── Outputs : map[string]*tfjson.StateOutput
 	// 		└── RootModule : *tfjson.StateModule
 	// 			├── Address : string
@@ -85,60 +144,100 @@ func Merge(ctx context.Context, tf *tfexec.Terraform, pulledState []byte, resolu
 	// -----------------------------------------------------
 
 	// This is basically main()
-	// For each stateFile ->
-	for _, stateFile := range stateFiles[:] {
-		state_absPath, err := filepath.Abs(stateFile)
-		if err != nil {
-			return nil, err
-		}
-		jsonFile, err := os.ReadFile(state_absPath)
-		if err != nil {
-			return nil, err
-		}
-		_ = json.Unmarshal(jsonFile, &thisState)
-		// Get state object
-		state, err := tf.ShowStateFile(ctx, state_absPath)
-		if err != nil {
-			result = multierror.Append(result, fmt.Errorf("showing state file %s: %v", stateFile, err))
-			continue
+	// Read all the stateFiles first, as they are grouped by lineage
+	inputs, baseState, err = readInputs(pulledState, opts.Identities, stateFiles, &report)
+	if err != nil {
+		return nil, nil, err
+	}
+	inputs, err = dedupeLineage(inputs, opts.StrictLineage, &report)
+	if err != nil {
+		return nil, nil, err
+	}
+	checkSchemaVersions(inputs, &report)
+	if opts.Deposed == "error" {
+		if err := checkDeposed(inputs); err != nil {
+			return nil, nil, err
 		}
-		// fmt.Println("==========HERE==========")
+	}
+
+	// The stateFile defining each output, and the highest serial of the lineage of the base state
+	outputsFrom := make(map[string]string)
+	baseSerial := -1
+	baseLineage, _ := baseState["lineage"].(string)
+
+	// For each stateFile ->
+	for _, input := range inputs {
+		stateFile, thisState := input.path, input.state
+		// Get the module tree of the state object
+		rootModule := stateModule(thisState)
 
 		// check_results := thisState["check_results"]
 		// fmt.Printf("--------| check_results: %s\n", check_results)
 		finalState.Checks, _ = json.Marshal(thisState["check_results"])
 
-		// outputs := thisState["outputs"]
-		// fmt.Printf("--------| outputs: %s\n", outputs)
+		if err := finalState.mergeOutputs(session, outputsFrom, stateFile, thisState); err != nil {
+			result = multierror.Append(result, fmt.Errorf("merging state file %s: %v", stateFile, err))
+		}
 
-		finalState.Outputs = m //json.Marshal(outputs)
+		// A missing serial is 0, like terraform reads it. The format version is always 4, as decodeState upgrades the older ones.
+		serial := stateSerial(thisState)
+		finalState.Serial = serial
+		// The base state might be superseded by a newer snapshot of its lineage
+		if lineage, _ := thisState["lineage"].(string); baseState != nil && lineage == baseLineage && serial > baseSerial {
+			baseSerial = serial
+		}
 
-		serial := int64(thisState["serial"].(float64))
-		finalState.Serial = int(serial) //.([]interface{})[0].(map[string]interface{})["instances"].([]interface{})
+		// Pass the unknown fields (e.g. added by a newer terraform) through, the first stateFile having one wins
+		for k, v := range unknownFields(thisState, stateFields) {
+			if _, ok := finalState.Extra[k]; ok {
+				continue
+			}
+			if finalState.Extra == nil {
+				finalState.Extra = make(map[string]interface{})
+			}
+			finalState.Extra[k] = v
+		}
 
-		version := int64(thisState["version"].(float64))
-		finalState.Version = int(version) //.([]interface{})[0].(map[string]interface{})["instances"].([]interface{})
 		// Run some checks on this StateFile object
-		// if finalState.checkState(state) && stateLedger.checkLedger(state) {
+		tfVersion, _ := thisState["terraform_version"].(string)
+		if err := checkTerraformVersion(stateFile, tfVersion, maxVersion); err != nil {
+			return nil, nil, err
+		}
+		if finalState.TerraformVersion, err = highestTerraformVersion(finalState.TerraformVersion, tfVersion); err != nil {
+			return nil, nil, err
+		}
+		// if stateLedger.checkLedger(state) {
 		// 	continue
 		// }
 
 		// Merge this stateFile into finalStateModule
-		finalState.mergeModules(stateLedger, state.Values.RootModule, resolution, jsonFile)
+		if err := finalState.mergeModules(session, stateLedger, rootModule, thisState); err != nil {
+			result = multierror.Append(result, fmt.Errorf("merging state file %s: %v", stateFile, err))
+		}
+	}
+	if err := result.ErrorOrNil(); err != nil {
+		return nil, nil, err
+	}
+	if baseState != nil {
+		finalState.Lineage = baseLineage
+		finalState.Serial = baseSerial + 1
 	}
 
-	// Construct the whole finalState before JSONifying it
-	finalStateValues.RootModule = finalStateModule
-	// finalStateValues.Outputs = finalStateOutput
-	// finalState.Checks = finalStateChecks
-	// finalstate.Resources = finalStateModule.Resources
+	// Look for the real objects managed by multiple addresses
+	if err := checkDuplicateObjects(finalState.Resources, opts.IdentityAttributes, opts.DuplicateObjects == "warn", &report); err != nil {
+		return nil, nil, err
+	}
 
-	// Return all resources as []byte
-	out, err := finalState.MarshalJSON()
+	// Report the provider configurations the merged state needs
+	report.Providers = finalState.providers()
+
+	// Return all resources as []byte, in the same layout as terraform writes the state file
+	finalState.sortResources()
+	out, err := marshalState(&finalState)
 	if err != nil {
-		return nil, fmt.Errorf("reading from merged state file %s: %v", "baseStateFile", err)
+		return nil, nil, fmt.Errorf("reading from merged state file %s: %v", "baseStateFile", err)
 	}
-	return out, nil
+	return out, &report, nil
 }
 
 func nilOrDefault(v any, def any) any {
@@ -155,74 +254,181 @@ func nilOrDefault(v any, def any) any {
 // 	return []byte
 // }
 
-// ------------------| State: FNs |------------------
-func (final *State) checkState(state *tfjson.State) bool {
-	if state.Values == nil {
-		return false
+// readInputs reads & decodes the base state (if any) and the state files, the base state is the first input.
+// Legacy (v3) stateFiles are upgraded to v4, and moved under the module of their NamedReader.
+// The outputs of a stateFile moved under a module are dropped, as only the outputs of the root module are kept in the state.
+func readInputs(pulledState []byte, identities []age.Identity, stateFiles []NamedReader, report *Report) ([]stateInput, map[string]interface{}, error) {
+	var inputs []stateInput
+	var baseState map[string]interface{}
+	// The base state is merged first, it takes part in the lineage grouping & terraform version reconciliation as well
+	if len(pulledState) != 0 {
+		b, err := readStateBytes(pulledState, identities)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading the base state: %v", err)
+		}
+		baseState, err = decodeState(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading the base state: %v", err)
+		}
+		inputs = append(inputs, stateInput{path: baseStateName, state: baseState})
 	}
-	// if final.Version != state.FormatVersion { // If Versions don't match
-	// 	return false
-	// }
-	if final.TerraformVersion != state.TerraformVersion { // If Versions don't match
-		return false
+	for _, stateFile := range stateFiles {
+		jsonFile, err := io.ReadAll(stateFile.Reader)
+		if err == nil {
+			// Encrypted & compressed stateFiles are decrypted & decompressed in memory
+			jsonFile, err = readStateBytes(jsonFile, identities)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading state file %s: %v", stateFile.Name, err)
+		}
+		// Decode the stateFile, legacy (v3) stateFiles are upgraded to v4 in memory
+		thisState, err := decodeState(jsonFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading state file %s: %v", stateFile.Name, err)
+		}
+		if stateFile.Module != "" {
+			if err := validateModuleAddr(stateFile.Module); err != nil {
+				return nil, nil, fmt.Errorf("moving state file %s: %v", stateFile.Name, err)
+			}
+			moveToModule(thisState, stateFile.Module)
+			if outputs, _ := thisState["outputs"].(map[string]interface{}); len(outputs) != 0 {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("the %d outputs of state file %s are dropped, as it is moved under %s", len(outputs), stateFile.Name, stateFile.Module))
+				thisState["outputs"] = map[string]interface{}{}
+			}
+		}
+		inputs = append(inputs, stateInput{path: stateFile.Name, state: thisState})
 	}
-	return true
+	return inputs, baseState, nil
+}
+
+// baseStateName is how the base state is referred to in errors and the report
+const baseStateName = "<base>"
+
+// stateModule builds the module tree of the decoded (v4) stateFile in the shape of `terraform show -json`, to be walked by mergeModules.
+// Only the addressing fields of the resources are set, the rest is looked up from the decoded stateFile.
+// NOTE: the child modules are flattened under the root module, as the nesting doesn't matter to mergeModules.
+func stateModule(thisState map[string]interface{}) *tfjson.StateModule {
+	root := &tfjson.StateModule{}
+	children := make(map[string]*tfjson.StateModule)
+	resources, _ := thisState["resources"].([]interface{})
+	for _, r := range resources {
+		res, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		module, _ := res["module"].(string)
+		mode, _ := res["mode"].(string)
+		typ, _ := res["type"].(string)
+		name, _ := res["name"].(string)
+		provider, _ := res["provider"].(string)
+		ref, _ := parseProviderRef(provider)
+
+		mod := root
+		if module != "" {
+			if mod = children[module]; mod == nil {
+				mod = &tfjson.StateModule{Address: module}
+				children[module] = mod
+				root.ChildModules = append(root.ChildModules, mod)
+			}
+		}
+		mod.Resources = append(mod.Resources, &tfjson.StateResource{
+			Address:      resourceAddr(module, mode, typ, name),
+			Mode:         tfjson.ResourceMode(mode),
+			Type:         typ,
+			Name:         name,
+			ProviderName: ref.source,
+		})
+	}
+	return root
 }
 
+// ------------------| State: FNs |------------------
 // add resource to parent map with whatever conflict resolution method
-// Takes RootModule for the stateFile
-func (state *State) mergeModules(stateLedger ledger, module *tfjson.StateModule, resolution string, jsonFile []byte) {
+// Takes RootModule for the stateFile, together with the decoded (v4) stateFile it is shown from
+func (state *State) mergeModules(session session, stateLedger ledger, module *tfjson.StateModule, thisState map[string]interface{}) error {
+	var result *multierror.Error
 	// If no modules, gracefully exit
 	if module == nil {
-		return
+		return nil
 	}
 
-	var thisState map[string]interface{}
-	_ = json.Unmarshal(jsonFile, &thisState)
-	// thisJson, _ := json.MarshalIndent(thisState, "", "\t")
-	// thisJson2, _ := json.MarshalIndent(thisState["resources"], "", "\t")
+	// Each instance of a resource shows up as a separate rsrc, only handle the resource once
+	seen := make(map[string]bool)
 	// Loop all Resources in RootModule
 	for _, rsrc := range module.Resources {
-		var addr string
-		if rsrc.Address != "" {
-			addr = rsrc.Address
-		} else {
-			addr = strings.Join([]string{rsrc.ProviderName, rsrc.Type, rsrc.Name}, ".")
+		addr := resourceAddr(module.Address, string(rsrc.Mode), rsrc.Type, rsrc.Name)
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		raw := findResource(thisState, module.Address, string(rsrc.Mode), rsrc.Type, rsrc.Name)
+		if raw == nil {
+			continue
+		}
+		instances, _ := raw["instances"].([]interface{})
+		if session.opts.Deposed == "drop" {
+			instances = dropDeposed(instances)
+		}
+		// Carry the provider configuration reference through unchanged, as it might be aliased or inherited from a module,
+		// e.g. `module.x.provider["registry.terraform.io/hashicorp/aws"].west`.
+		provider, _ := raw["provider"].(string)
+		if provider == "" {
+			provider = fmt.Sprintf("provider[\"%s\"]", rsrc.ProviderName)
+		}
+
+		each, _ := raw["each"].(string)
+		provider, err := session.providers.apply(provider)
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("resource %s: %v", addr, err))
+			continue
 		}
-		instances := thisState["resources"].([]interface{})[0].(map[string]interface{})["instances"].([]interface{})
 
 		this := Resource{
-			SchemaVersion: rsrc.SchemaVersion,
-			Module:        module.Address,
-			Mode:          string(rsrc.Mode),
-			Type:          rsrc.Type,
-			Name:          rsrc.Name,
-			Provider:      fmt.Sprintf("provider[\"%s\"]", rsrc.ProviderName),
-			DependsOn:     nilOrDefault(rsrc.DependsOn, []string{}).([]string),
-			// SensitiveValues: sv,
+			Module:    module.Address,
+			Mode:      string(rsrc.Mode),
+			Type:      rsrc.Type,
+			Name:      rsrc.Name,
+			Each:      each,
+			Provider:  provider,
 			Instances: instances,
+			Extra:     unknownFields(raw, resourceFields),
+		}
+		// Data sources are only cached reads, handle them by the data sources policy instead
+		if this.Mode == string(tfjson.DataResourceMode) {
+			switch session.opts.DataSources {
+			case "drop": // leave them to be read on the next refresh
+				continue
+			case "keep": // treat them the same as managed resources
+			default: // dedupe: silently keep the first occurance
+				if stateLedger.Resource[addr] != nil {
+					continue
+				}
+			}
 		}
 		// If rsrc already in state -> use resolution
 		if stateLedger.Resource[addr] != nil {
-			switch resolution {
-			case "overwrite": // takes the newer module
-				fmt.Println("Overwrite old with new occurance")
-				state.Resources = append(state.Resources, this)
+			existing := state.findResource(addr)
+			if existing == nil {
 				continue
+			}
+			switch session.opts.Resolution {
+			case "overwrite": // takes the newer module
+				log.Printf("Overwrite old with new occurance of %s", addr)
+				existing.resolveInstances(this, true, session.report)
 			case "merge": // attempt to merge both occurances
-				fmt.Println("Merge both occurances")
-				// TODO: Implement a logical merge action
-				// state.Resources[rsrc.Address] = mergeResources(state.Resources[rsrc.Address], rsrc)
-				continue
+				log.Printf("Merge both occurances of %s", addr)
+				if err := existing.mergeInstances(this, session.report); err != nil {
+					result = multierror.Append(result, fmt.Errorf("merging resource %s: %v", addr, err))
+				}
 			case "skip": // skips new occurances
-				fmt.Println("Skip new occurance")
-				continue
-			default: // Defaults to original functionality; ie skip but include errors
-				fmt.Println("Hit Default Switch")
-				// TODO: Decide if added multierror is worth it
-				// result = multierror.Append(result, fmt.Errorf(`resource %s is defined in both state files %s and %s`, res.Address, stateFile, oStateFile))
-				continue
+				log.Printf("Skip new occurance of %s", addr)
+				existing.resolveInstances(this, false, session.report)
+			default: // Defaults to original functionality; ie error on any conflict
+				log.Printf("Conflicting occurances of %s", addr)
+				result = multierror.Append(result, fmt.Errorf("resource %s is defined in more than one state file", addr))
 			}
+			continue
 		}
 		// Update the stateLedger
 		stateLedger.Resource[addr] = rsrc
@@ -233,8 +439,143 @@ func (state *State) mergeModules(stateLedger ledger, module *tfjson.StateModule,
 
 	// Loop all the ChildModules in RootModule
 	for _, mod := range module.ChildModules {
-		state.mergeModules(stateLedger, mod, resolution, jsonFile)
+		if err := state.mergeModules(session, stateLedger, mod, thisState); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// mergeOutputs merges the outputs of the stateFile into the merged state, outputsFrom records the stateFile defining each of them.
+// The same output defined identically in multiple stateFiles is kept once, otherwise it is resolved like a resource:
+// "overwrite" takes the later definition, "skip" keeps the earlier one, anything else is a conflict.
+func (state *State) mergeOutputs(session session, outputsFrom map[string]string, stateFile string, thisState map[string]interface{}) error {
+	var result *multierror.Error
+	outputs, _ := thisState["outputs"].(map[string]interface{})
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		output := outputs[name]
+		existing, ok := state.Outputs[name]
+		switch {
+		case !ok:
+		case reflect.DeepEqual(existing, output):
+			continue
+		case session.opts.Resolution == "overwrite":
+			log.Printf("Overwrite old with new occurance of output %s", name)
+		case session.opts.Resolution == "skip":
+			log.Printf("Skip new occurance of output %s", name)
+			continue
+		default:
+			result = multierror.Append(result, fmt.Errorf("output %s is defined differently in state file %s", name, outputsFrom[name]))
+			continue
+		}
+		state.Outputs[name] = output
+		outputsFrom[name] = stateFile
+	}
+	return result.ErrorOrNil()
+}
+
+// providers returns the sorted provider configurations referenced by the merged resources
+func (state *State) providers() []string {
+	seen := make(map[string]bool)
+	var providers []string
+	for _, res := range state.Resources {
+		if res.Provider == "" || seen[res.Provider] {
+			continue
+		}
+		seen[res.Provider] = true
+		providers = append(providers, res.Provider)
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+// findResource returns the merged resource by its address (without instance key); nil if not found
+func (state *State) findResource(addr string) *Resource {
+	for i, res := range state.Resources {
+		if resourceAddr(res.Module, res.Mode, res.Type, res.Name) == addr {
+			return &state.Resources[i]
+		}
+	}
+	return nil
+}
+
+// mergeInstances merges the instances of another occurance of the same resource into this one.
+// Instances are identified by their index key (and deposed key); the same instance must be identical in both occurances,
+// unless only one of them is tainted, then the clean one is kept.
+// Instances of different schema versions are never combined, as the provider would upgrade them inconsistently.
+func (res *Resource) mergeInstances(other Resource, report *Report) error {
+	if res == nil {
+		return fmt.Errorf("resource not found")
+	}
+	for _, inst := range res.Instances {
+		instance, _ := inst.(map[string]interface{})
+		for _, oinst := range other.Instances {
+			oinstance, _ := oinst.(map[string]interface{})
+			if sv, osv := instanceSchemaVersion(instance), instanceSchemaVersion(oinstance); sv != osv {
+				return fmt.Errorf("refusing to merge instances of different schema versions %d and %d", sv, osv)
+			}
+		}
+	}
+	addr := resourceAddr(res.Module, res.Mode, res.Type, res.Name)
+	for _, oinst := range other.Instances {
+		oinstance, _ := oinst.(map[string]interface{})
+		merged := false
+		for i, inst := range res.Instances {
+			instance, _ := inst.(map[string]interface{})
+			if keyOf(instance) != keyOf(oinstance) {
+				continue
+			}
+			merged = true
+			if reflect.DeepEqual(instance, oinstance) {
+				break
+			}
+			if isTainted(instance) == isTainted(oinstance) {
+				return fmt.Errorf("instance %s differs between the occurances", instanceAddr(addr, oinstance["index_key"]))
+			}
+			report.Warnings = append(report.Warnings, fmt.Sprintf("instance %s is tainted in one of the state files, keeping the clean one", instanceAddr(addr, oinstance["index_key"])))
+			if isTainted(instance) {
+				res.Instances[i] = oinstance
+			}
+			break
+		}
+		if !merged {
+			res.Instances = append(res.Instances, oinstance)
+		}
+	}
+	return nil
+}
+
+// resourceAddr returns the address of the resource (not the resource instance), e.g. "module.a.data.null_data_source.test"
+func resourceAddr(module, mode, typ, name string) string {
+	addr := typ + "." + name
+	if mode == string(tfjson.DataResourceMode) {
+		addr = "data." + addr
+	}
+	if module != "" {
+		addr = module + "." + addr
+	}
+	return addr
+}
+
+// findResource returns the resource of the decoded stateFile by its module, mode, type and name; nil if not found
+func findResource(thisState map[string]interface{}, module, mode, typ, name string) map[string]interface{} {
+	resources, _ := thisState["resources"].([]interface{})
+	for _, r := range resources {
+		res, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		resModule, _ := res["module"].(string)
+		if resModule == module && res["mode"] == mode && res["type"] == typ && res["name"] == name {
+			return res
+		}
 	}
+	return nil
 }
 
 // ------------------| ledger: FNs |------------------
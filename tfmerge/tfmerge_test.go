@@ -1,6 +1,7 @@
 package tfmerge
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,53 +11,16 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
-	"github.com/hashicorp/go-version"
-	install "github.com/hashicorp/hc-install"
-	"github.com/hashicorp/hc-install/fs"
-	"github.com/hashicorp/hc-install/product"
-	"github.com/hashicorp/hc-install/src"
-	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
 	"github.com/stretchr/testify/require"
 )
 
-func initTest(ctx context.Context, t *testing.T) *tfexec.Terraform {
+func initTest(t *testing.T) {
 	// Discard log output
 	log.SetOutput(io.Discard)
-
-	// Init terraform with null provider
-	dir := t.TempDir()
-	i := install.NewInstaller()
-	tfpath, err := i.Ensure(ctx, []src.Source{
-		&fs.Version{
-			Product:     product.Terraform,
-			Constraints: version.MustConstraints(version.NewConstraint(">=1.1.0")),
-		},
-	})
-	if err != nil {
-		t.Fatalf("finding a terraform executable: %v", err)
-	}
-	tf, err := tfexec.NewTerraform(dir, tfpath)
-	if err != nil {
-		t.Fatalf("error running NewTerraform: %v", err)
-	}
-	if err := os.WriteFile(filepath.Join(dir, "terraform.tf"), []byte(`terraform {
-  required_providers {
-    null = {
-      source = "hashicorp/null"
-    }
-  }
-}
-`), 0644); err != nil {
-		t.Fatal(err)
-	}
-
-	if err := tf.Init(ctx); err != nil {
-		t.Fatal(err)
-	}
-
-	return tf
 }
 
 func testFixture(t *testing.T, name string) (stateFiles []string, expectState []byte) {
@@ -123,6 +87,8 @@ func compareStates(t *testing.T, input, expected *State) ([]difference, []error)
 			errs = append(errs, diffs.compareResources(t, input.Resources, expected.Resources)...)
 		case "Checks":
 			require.JSONEq(t, string(expected.Checks), string(input.Checks))
+		case "Extra":
+			require.Equal(t, expected.Extra, input.Extra)
 		case "Outputs":
 			if !reflect.DeepEqual(actual, expected) {
 				errmsg := fmt.Sprintf("---| DeepEqualFailure |---\n--| Actual: %v\n--| Expect: %v\n", actual, expected)
@@ -180,10 +146,10 @@ func TestMerge(t *testing.T) {
 
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
-			ctx := context.Background()                                                   // Set context
-			tf := initTest(ctx, t)                                                        // terraform init
-			stateFiles, expect := testFixture(t, tt.dir)                                  // Grabs the StateFiles & the Expected State
-			actual, err := Merge(ctx, tf, []byte(tt.baseState), "default", stateFiles...) // Run Merge()
+			ctx := context.Background()                                                                    // Set context
+			initTest(t)                                                                                    // Discard log output
+			stateFiles, expect := testFixture(t, tt.dir)                                                   // Grabs the StateFiles & the Expected State
+			actual, err := Merge(ctx, []byte(tt.baseState), Options{Resolution: "default"}, stateFiles...) // Run Merge()
 			if tt.hasError {
 				require.Error(t, err)
 				return
@@ -215,3 +181,192 @@ func TestMerge(t *testing.T) {
 // For each case
 // Run each test
 //
+
+func TestMergeModulesDataSources(t *testing.T) {
+	module := &tfjson.StateModule{
+		Resources: []*tfjson.StateResource{
+			{Address: "data.null_data_source.test", Mode: tfjson.DataResourceMode, Type: "null_data_source", Name: "test", ProviderName: "registry.terraform.io/hashicorp/null"},
+		},
+	}
+	rawState := func(id string) map[string]interface{} {
+		return map[string]interface{}{
+			"resources": []interface{}{
+				map[string]interface{}{
+					"mode":      "data",
+					"type":      "null_data_source",
+					"name":      "test",
+					"provider":  `provider["registry.terraform.io/hashicorp/null"]`,
+					"instances": []interface{}{map[string]interface{}{"attributes": map[string]interface{}{"id": id}}},
+				},
+			},
+		}
+	}
+
+	for _, policy := range []string{"", "dedupe", "keep", "drop"} {
+		t.Run(policy, func(t *testing.T) {
+			var state State
+			var stateLedger ledger
+			stateLedger.init()
+			session := session{opts: Options{DataSources: policy, Resolution: "merge"}, report: &Report{}}
+			err1 := state.mergeModules(session, stateLedger, module, rawState("1"))
+			err2 := state.mergeModules(session, stateLedger, module, rawState("2"))
+			require.NoError(t, err1)
+
+			switch policy {
+			case "drop":
+				require.NoError(t, err2)
+				require.Empty(t, state.Resources)
+			case "keep":
+				// Conflicting data sources are resolved the same as managed resources
+				require.Error(t, err2)
+			default:
+				require.NoError(t, err2)
+				require.Len(t, state.Resources, 1)
+				require.Equal(t, "1", state.Resources[0].Instances[0].(map[string]interface{})["attributes"].(map[string]interface{})["id"])
+			}
+		})
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	stateFiles, _ := testFixture(t, "unknown_fields")
+	for _, stateFile := range stateFiles {
+		b, err := os.ReadFile(stateFile)
+		require.NoError(t, err)
+
+		// Round trip
+		var state State
+		require.NoError(t, json.Unmarshal(b, &state))
+		out, err := json.Marshal(&state)
+		require.NoError(t, err)
+		require.JSONEq(t, string(b), string(out))
+	}
+
+	// Merge
+	b, err := os.ReadFile(filepath.Join("testdata", "unknown_fields", "state1"))
+	require.NoError(t, err)
+	thisState, err := decodeState(b)
+	require.NoError(t, err)
+	module := &tfjson.StateModule{
+		Resources: []*tfjson.StateResource{
+			{Address: "null_resource.test[0]", Mode: tfjson.ManagedResourceMode, Type: "null_resource", Name: "test", Index: 0, ProviderName: "registry.terraform.io/hashicorp/null"},
+		},
+	}
+	var state State
+	var stateLedger ledger
+	stateLedger.init()
+	require.NoError(t, state.mergeModules(session{report: &Report{}}, stateLedger, module, thisState))
+	out, err := json.Marshal(state.Resources)
+	require.NoError(t, err)
+	expect, err := json.Marshal(thisState["resources"])
+	require.NoError(t, err)
+	require.JSONEq(t, string(expect), string(out))
+}
+
+func TestMergeReaders(t *testing.T) {
+	initTest(t)
+	stateFiles, _ := testFixture(t, "resource_only")
+	expect, err := Merge(context.Background(), nil, Options{}, stateFiles...)
+	require.NoError(t, err)
+
+	var readers []NamedReader
+	for _, stateFile := range stateFiles {
+		b, err := os.ReadFile(stateFile)
+		require.NoError(t, err)
+		readers = append(readers, NamedReader{Name: stateFile, Reader: bytes.NewReader(b)})
+	}
+	actual, _, err := MergeReaders(context.Background(), nil, Options{}, readers)
+	require.NoError(t, err)
+	require.Equal(t, string(expect), string(actual))
+
+	_, _, err = MergeReaders(context.Background(), nil, Options{}, []NamedReader{{Name: "<stdin>", Reader: strings.NewReader("not a state")}})
+	require.ErrorContains(t, err, "<stdin>")
+
+	// A hand-made state without serial has serial 0, like terraform reads it
+	out, _, err := MergeReaders(context.Background(), nil, Options{}, []NamedReader{{Name: "<stdin>", Reader: strings.NewReader(`{"version": 4, "lineage": "x", "resources": []}`)}})
+	require.NoError(t, err)
+	var state State
+	require.NoError(t, json.Unmarshal(out, &state))
+	require.Equal(t, 4, state.Version)
+	require.Equal(t, 0, state.Serial)
+}
+
+func TestMergeOutputs(t *testing.T) {
+	initTest(t)
+	state := func(lineage string, serial int, outputs string) NamedReader {
+		return NamedReader{Name: lineage, Reader: strings.NewReader(fmt.Sprintf(`{"version": 4, "serial": %d, "lineage": %q, "outputs": %s, "resources": []}`, serial, lineage, outputs))}
+	}
+	outputs := func(b []byte) map[string]interface{} {
+		var v struct {
+			Outputs map[string]interface{} `json:"outputs"`
+		}
+		require.NoError(t, json.Unmarshal(b, &v))
+		return v.Outputs
+	}
+	base := []byte(`{"version": 4, "serial": 1, "lineage": "base", "outputs": {"a": {"value": "base", "type": "string"}}, "resources": []}`)
+
+	// The outputs of the base state come first, the same definitions don't conflict
+	b, _, err := MergeReaders(context.Background(), base, Options{}, []NamedReader{
+		state("x", 1, `{"a": {"value": "base", "type": "string"}, "b": {"value": "x", "type": "string", "sensitive": true}}`),
+		state("y", 1, `{"c": {"value": 1, "type": "number"}}`),
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"a": map[string]interface{}{"value": "base", "type": "string"},
+		"b": map[string]interface{}{"value": "x", "type": "string", "sensitive": true},
+		"c": map[string]interface{}{"value": float64(1), "type": "number"},
+	}, outputs(b))
+
+	// Different definitions are resolved like the resources
+	conflicting := func() []NamedReader {
+		return []NamedReader{state("x", 1, `{"a": {"value": "x", "type": "string"}}`)}
+	}
+	_, _, err = MergeReaders(context.Background(), base, Options{}, conflicting())
+	require.ErrorContains(t, err, "output a is defined differently in state file <base>")
+	_, _, err = MergeReaders(context.Background(), base, Options{Resolution: "merge"}, conflicting())
+	require.ErrorContains(t, err, "output a is defined differently")
+	b, _, err = MergeReaders(context.Background(), base, Options{Resolution: "overwrite"}, conflicting())
+	require.NoError(t, err)
+	require.Equal(t, "x", outputs(b)["a"].(map[string]interface{})["value"])
+	b, _, err = MergeReaders(context.Background(), base, Options{Resolution: "skip"}, conflicting())
+	require.NoError(t, err)
+	require.Equal(t, "base", outputs(b)["a"].(map[string]interface{})["value"])
+
+	// The outputs of a state file moved under a module aren't root module outputs anymore
+	moved := state("x", 1, `{"a": {"value": "x", "type": "string"}}`)
+	moved.Module = "module.x"
+	b, report, err := MergeReaders(context.Background(), base, Options{}, []NamedReader{moved})
+	require.NoError(t, err)
+	require.Equal(t, "base", outputs(b)["a"].(map[string]interface{})["value"])
+	require.Contains(t, report.Warnings, "the 1 outputs of state file x are dropped, as it is moved under module.x")
+}
+
+func TestMergeSerial(t *testing.T) {
+	initTest(t)
+	state := func(name, lineage string, serial int) NamedReader {
+		return NamedReader{Name: name, Reader: strings.NewReader(fmt.Sprintf(`{"version": 4, "serial": %d, "lineage": %q, "outputs": {}, "resources": []}`, serial, lineage))}
+	}
+	serial := func(b []byte) (string, int) {
+		var v struct {
+			Lineage string `json:"lineage"`
+			Serial  int    `json:"serial"`
+		}
+		require.NoError(t, json.Unmarshal(b, &v))
+		return v.Lineage, v.Serial
+	}
+	base := []byte(`{"version": 4, "serial": 3, "lineage": "base", "outputs": {}, "resources": []}`)
+
+	b, _, err := MergeReaders(context.Background(), base, Options{}, []NamedReader{state("x", "x", 10)})
+	require.NoError(t, err)
+	lineage, s := serial(b)
+	require.Equal(t, "base", lineage)
+	require.Equal(t, 4, s)
+
+	// The base state is superseded by a newer snapshot of its lineage
+	b, report, err := MergeReaders(context.Background(), base, Options{}, []NamedReader{state("x", "x", 10), state("newer", "base", 7)})
+	require.NoError(t, err)
+	require.Len(t, report.Superseded, 1)
+	lineage, s = serial(b)
+	require.Equal(t, "base", lineage)
+	require.Equal(t, 8, s)
+}
@@ -3,11 +3,9 @@ package tfmerge
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"path/filepath"
-	"strconv"
+	"io"
 
-	"github.com/hashicorp/terraform-exec/tfexec"
+	"filippo.io/age"
 	tfjson "github.com/hashicorp/terraform-json"
 )
 
@@ -47,24 +45,29 @@ type State struct {
 	Resources        []Resource             `json:"resources,omitempty"`
 	Checks           json.RawMessage        `json:"check_results"`
 	Outputs          map[string]interface{} `json:"outputs"`
+	// Extra holds the fields unknown to tfmerge (e.g. added by a newer terraform), which are passed through untouched
+	Extra map[string]interface{} `json:"-"`
 }
 
+// Resource is a resource of the state, the fields are in the order terraform writes them.
+// The schema version, dependencies, sensitive attributes etc. are per instance, they are kept in the Instances.
 type Resource struct {
-	SchemaVersion   uint64          `json:"schema_version,omitempty"`
-	Module          string          `json:"module,omitempty"`
-	Mode            string          `json:"mode"`
-	Type            string          `json:"type"`
-	Name            string          `json:"name"`
-	Provider        string          `json:"provider"`
-	Private         string          `json:"private,omitempty"`
-	DependsOn       []string        `json:"dependencies,omitempty"`
-	SensitiveValues json.RawMessage `json:"sensitive_attributes,omitempty"`
-	Instances       []interface{}   `json:"instances"`
+	Module    string        `json:"module,omitempty"`
+	Mode      string        `json:"mode"`
+	Type      string        `json:"type"`
+	Name      string        `json:"name"`
+	Each      string        `json:"each,omitempty"`
+	Provider  string        `json:"provider"`
+	Instances []interface{} `json:"instances"`
+	// Extra holds the fields unknown to tfmerge, which are passed through untouched.
+	// The instances are passed through as a whole, so they don't need one.
+	Extra map[string]interface{} `json:"-"`
 }
 
+// StateValues is the values of a state in the `terraform show -json` format, i.e. its outputs and module tree.
 type StateValues struct {
-	Outputs    tfjson.StateOutput
-	RootModule StateModule
+	Outputs    map[string]*tfjson.StateOutput `json:"outputs,omitempty"`
+	RootModule *StateModule                   `json:"root_module"`
 }
 
 type CheckResultStatic struct {
@@ -98,9 +101,81 @@ type CheckResultProblem struct {
 	Message string `json:"message"`
 }
 
-type session struct { // This just makes it easier to pass ctx & tf to sub functions
-	ctx *context.Context
-	tf  *tfexec.Terraform
+// Options controls how Merge combines the state files.
+type Options struct {
+	// Resolution is how to handle resource address conflicts: "overwrite", "merge", "skip" or "" (default).
+	Resolution string
+	// MaxTerraformVersion, if set, refuses state files written by a newer terraform.
+	MaxTerraformVersion string
+	// StrictLineage errors if multiple state files share the same lineage, instead of only merging the highest serial one.
+	StrictLineage bool
+	// DuplicateObjects is how to handle a real object managed by multiple addresses: "error" (default) or "warn".
+	DuplicateObjects string
+	// IdentityAttributes overrides the attribute identifying the real object per resource type, it is "id" by default.
+	IdentityAttributes map[string]string
+	// ProviderMap remaps the provider of the merged resources, from -> to. Both can be provider source addresses
+	// (e.g. "registry.terraform.io/hashicorp/aws") or provider configurations (e.g. `provider["registry.terraform.io/hashicorp/aws"].west`).
+	ProviderMap map[string]string
+	// DataSources is how to handle the data sources: "keep" them as managed resources, "drop" them,
+	// or "dedupe" (default), which silently keeps the first occurance of conflicting data sources.
+	DataSources string
+	// Deposed is how to handle the deposed objects: "keep" (default), "drop" them, or "error" to refuse to merge them.
+	Deposed string
+	// Identities decrypt the age encrypted state files (and base state), in memory.
+	Identities []age.Identity
+}
+
+// Report describes what Merge did to the state files, besides the merged state itself.
+type Report struct {
+	Warnings         []string
+	Superseded       []Superseded
+	DuplicateObjects []DuplicateObject
+	// SchemaVersionMismatches are the resource types with different schema versions across the state files
+	SchemaVersionMismatches []SchemaVersionMismatch
+	// Providers are the provider configurations referenced by the merged state, which the configuration must provide
+	Providers []string
+}
+
+// Superseded is a state file that is not merged, as it is an older snapshot of the same lineage as another state file.
+type Superseded struct {
+	StateFile string
+	Serial    int
+	Lineage   string
+	By        string // The state file it is superseded by
+	BySerial  int
+}
+
+// DuplicateObject is a real object that is managed by multiple resource instance addresses in the merged state.
+type DuplicateObject struct {
+	Type      string
+	Identity  string
+	Addresses []string
+}
+
+// SchemaVersionMismatch is a resource type whose instances have different schema versions across the state files.
+type SchemaVersionMismatch struct {
+	Type       string
+	StateFiles map[uint64][]string // schema version -> state files
+}
+
+type session struct { // This just makes it easier to pass ctx (and the merge settings) to sub functions
+	ctx       *context.Context
+	opts      Options
+	providers *providerMapper
+	report    *Report
+}
+
+type stateInput struct { // A state file to be merged, decoded as format version 4
+	path  string // As passed to Merge (or the name of its NamedReader)
+	state map[string]interface{}
+}
+
+// NamedReader is a state file to be merged by MergeReaders, read from Reader and referred to by Name.
+// If Module is set (e.g. "module.network"), the resources of the state file are moved under that module.
+type NamedReader struct {
+	Name   string
+	Reader io.Reader
+	Module string
 }
 
 type ledger struct { // This struct is used to track what resources are already in the state
@@ -110,18 +185,10 @@ type ledger struct { // This struct is used to track what resources are already
 }
 
 // ---------------|CONSTRUCTOR FUNC|---------------
-// Constructor: pulls version info from first statefile and initializes finalState
-func (state *State) init(session session, path string) {
-	state_absPath, err := filepath.Abs(path)
-	if err != nil {
-		fmt.Println("error in <State>.init()")
-	}
-	stateFile, err := session.tf.ShowStateFile(*session.ctx, state_absPath)
-	if err != nil {
-		fmt.Println("error in <State>.init()")
-	}
-	state.Version, _ = strconv.Atoi(stateFile.FormatVersion)
-	state.TerraformVersion = stateFile.TerraformVersion
+// Constructor: initializes finalState, the merged state is always written in format version 4
+// NOTE: the terraform_version is reconciled across all statefiles in Merge()
+func (state *State) init() {
+	state.Version = 4
 }
 
 func (ledger *ledger) init() {
@@ -0,0 +1,361 @@
+package tfmerge
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ------------------| DOCUMENTATION |------------------
+// Terraform v0.11 and earlier write state files in format version 3:
+//
+//	{
+//	  "version": 3,
+//	  "modules": [
+//	    {
+//	      "path": ["root", "child"],
+//	      "outputs": { "name": { "sensitive": false, "type": "string", "value": "..." } },
+//	      "resources": {
+//	        "aws_instance.foo.1": {
+//	          "type": "aws_instance",
+//	          "depends_on": ["aws_vpc.main"],
+//	          "provider": "provider.aws.west",
+//	          "primary": { "id": "...", "attributes": {...}, "meta": {...}, "tainted": false },
+//	          "deposed": [ {...} ]
+//	        }
+//	      }
+//	    }
+//	  ]
+//	}
+//
+// decodeState upgrades them in memory to format version 4, the same way `terraform` does,
+// so that they can be merged together with the newer state files.
+//
+// Terraform v0.12 writes format version 4, but with the legacy provider references of the resources, e.g. "provider.aws.west"
+// or "module.a.provider.aws". decodeState upgrades them to the provider addresses of the newer state files as well.
+//
+// ------------------------------------------------------
+
+// defaultProviderNamespace is the registry namespace assumed for the legacy (v3) provider references.
+const defaultProviderNamespace = "registry.terraform.io/hashicorp"
+
+// decodeState unmarshals the state file content, upgrading it to format version 4 if needed.
+func decodeState(b []byte) (map[string]interface{}, error) {
+	var state map[string]interface{}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	formatVersion, ok := state["version"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("missing state format version")
+	}
+	switch int(formatVersion) {
+	case 4:
+		if serial, ok := state["serial"]; ok {
+			if _, ok := serial.(float64); !ok {
+				return nil, fmt.Errorf("invalid state serial %v", serial)
+			}
+		}
+		upgradeLegacyProviders(state)
+		return state, nil
+	case 3:
+		return upgradeStateV3(state)
+	default:
+		return nil, fmt.Errorf("unsupported state format version %d", int(formatVersion))
+	}
+}
+
+// upgradeStateV3 converts a format version 3 state into a format version 4 state.
+func upgradeStateV3(old map[string]interface{}) (map[string]interface{}, error) {
+	state := map[string]interface{}{
+		"version":           float64(4),
+		"terraform_version": nilOrDefault(old["terraform_version"], ""),
+		"serial":            nilOrDefault(old["serial"], float64(0)),
+		"lineage":           nilOrDefault(old["lineage"], ""),
+		"outputs":           map[string]interface{}{},
+		"check_results":     nil,
+	}
+	resources := []interface{}{}
+
+	modules, _ := old["modules"].([]interface{})
+	for _, m := range modules {
+		mod, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		moduleAddr, err := legacyModuleAddr(mod["path"])
+		if err != nil {
+			return nil, err
+		}
+
+		// Only the root module outputs are persisted since format version 4
+		if moduleAddr == "" {
+			outputs, _ := mod["outputs"].(map[string]interface{})
+			for name, o := range outputs {
+				output, _ := o.(map[string]interface{})
+				state["outputs"].(map[string]interface{})[name] = map[string]interface{}{
+					"value":     output["value"],
+					"type":      impliedType(output["value"]),
+					"sensitive": nilOrDefault(output["sensitive"], false),
+				}
+			}
+		}
+
+		oldResources, _ := mod["resources"].(map[string]interface{})
+		upgraded, err := upgradeResourcesV3(moduleAddr, oldResources)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, upgraded...)
+	}
+	state["resources"] = resources
+	return state, nil
+}
+
+// upgradeResourcesV3 converts the per module resource map of a version 3 state to the version 4 resource list.
+// The resource instances keyed by e.g. "aws_instance.foo.0" and "aws_instance.foo.1" are grouped into one resource.
+func upgradeResourcesV3(moduleAddr string, oldResources map[string]interface{}) ([]interface{}, error) {
+	var resources []interface{}
+	byAddr := map[string]map[string]interface{}{}
+
+	// Sort the keys so that the resources and their instances are in a stable order
+	keys := make([]string, 0, len(oldResources))
+	for k := range oldResources {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		rs, ok := oldResources[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		mode, typ, name, index, err := parseLegacyResourceKey(key)
+		if err != nil {
+			return nil, err
+		}
+		addr := resourceAddr(moduleAddr, mode, typ, name)
+		resource, ok := byAddr[addr]
+		if !ok {
+			resource = map[string]interface{}{
+				"mode":      mode,
+				"type":      typ,
+				"name":      name,
+				"provider":  upgradeProviderAddr(moduleAddr, typ, stringOrEmpty(rs["provider"])),
+				"instances": []interface{}{},
+			}
+			if moduleAddr != "" {
+				resource["module"] = moduleAddr
+			}
+			byAddr[addr] = resource
+			resources = append(resources, resource)
+		}
+
+		dependencies := []interface{}{}
+		dependsOn, _ := rs["depends_on"].([]interface{})
+		for _, dep := range dependsOn {
+			if dep, ok := dep.(string); ok && dep != "" {
+				dependencies = append(dependencies, upgradeDependency(moduleAddr, dep))
+			}
+		}
+
+		var instances []interface{}
+		if primary, ok := rs["primary"].(map[string]interface{}); ok {
+			instances = append(instances, upgradeInstanceV3(primary, index, "", dependencies))
+		}
+		deposed, _ := rs["deposed"].([]interface{})
+		for i, d := range deposed {
+			if d, ok := d.(map[string]interface{}); ok {
+				// Terraform generates random deposed keys, use stable ones instead
+				instances = append(instances, upgradeInstanceV3(d, index, fmt.Sprintf("%08x", i+1), dependencies))
+			}
+		}
+		resource["instances"] = append(resource["instances"].([]interface{}), instances...)
+		if index != nil {
+			resource["each"] = "list"
+		}
+	}
+
+	// A "count" resource might have its first instance keyed without the index (e.g. "aws_instance.foo" and "aws_instance.foo.1")
+	for _, r := range resources {
+		resource := r.(map[string]interface{})
+		if resource["each"] != "list" {
+			continue
+		}
+		for _, inst := range resource["instances"].([]interface{}) {
+			instance := inst.(map[string]interface{})
+			if _, ok := instance["index_key"]; !ok {
+				instance["index_key"] = float64(0)
+			}
+		}
+	}
+	return resources, nil
+}
+
+// upgradeInstanceV3 converts a version 3 instance ("primary" or one of the "deposed") to a version 4 instance object.
+func upgradeInstanceV3(old map[string]interface{}, index interface{}, deposedKey string, dependencies []interface{}) map[string]interface{} {
+	instance := map[string]interface{}{
+		"schema_version":       float64(0),
+		"attributes_flat":      nilOrDefault(old["attributes"], map[string]interface{}{}),
+		"sensitive_attributes": []interface{}{},
+		"dependencies":         dependencies,
+	}
+	if index != nil {
+		instance["index_key"] = index
+	}
+	if deposedKey != "" {
+		instance["deposed"] = deposedKey
+	}
+	if tainted, _ := old["tainted"].(bool); tainted {
+		instance["status"] = "tainted"
+	}
+
+	// The schema version lives in the meta, the rest of the meta becomes the private data
+	if meta, ok := old["meta"].(map[string]interface{}); ok && len(meta) != 0 {
+		private := map[string]interface{}{}
+		for k, v := range meta {
+			if k == "schema_version" {
+				if sv, err := strconv.ParseUint(fmt.Sprint(v), 10, 64); err == nil {
+					instance["schema_version"] = float64(sv)
+				}
+				continue
+			}
+			private[k] = v
+		}
+		if len(private) != 0 {
+			// Private is bytes, which is base64 encoded in JSON
+			b, _ := json.Marshal(private)
+			instance["private"] = base64.StdEncoding.EncodeToString(b)
+		}
+	}
+	return instance
+}
+
+// legacyModuleAddr converts a version 3 module path (e.g. ["root", "a", "b"]) to a module address (e.g. "module.a.module.b").
+func legacyModuleAddr(path interface{}) (string, error) {
+	segments, _ := path.([]interface{})
+	if len(segments) == 0 || segments[0] != "root" {
+		return "", fmt.Errorf("invalid module path %v", path)
+	}
+	var parts []string
+	for _, seg := range segments[1:] {
+		name, ok := seg.(string)
+		if !ok || name == "" {
+			return "", fmt.Errorf("invalid module path %v", path)
+		}
+		parts = append(parts, "module."+name)
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// parseLegacyResourceKey parses a version 3 resource key, e.g. "data.aws_ami.foo.1", into its parts.
+// The index is nil if the key has none.
+func parseLegacyResourceKey(key string) (mode, typ, name string, index interface{}, err error) {
+	parts := strings.Split(key, ".")
+	mode = "managed"
+	if parts[0] == "data" {
+		mode = "data"
+		parts = parts[1:]
+	}
+	switch len(parts) {
+	case 2:
+	case 3:
+		i, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return "", "", "", nil, fmt.Errorf("invalid resource key %q: %v", key, err)
+		}
+		index = float64(i)
+	default:
+		return "", "", "", nil, fmt.Errorf("invalid resource key %q", key)
+	}
+	return mode, parts[0], parts[1], index, nil
+}
+
+// upgradeProviderAddr converts a legacy provider reference (e.g. "provider.aws.west", "module.a.provider.aws")
+// to a version 4 provider address (e.g. `provider["registry.terraform.io/hashicorp/aws"].west`).
+// An empty reference means the default provider of the resource type, e.g. "aws" for "aws_instance".
+func upgradeProviderAddr(moduleAddr, resourceType, legacy string) string {
+	var name, alias string
+	if legacy == "" {
+		name = strings.SplitN(resourceType, "_", 2)[0]
+	} else {
+		// A reference to a provider in another module has the module address as prefix
+		if i := strings.LastIndex(legacy, "provider."); i > 0 {
+			moduleAddr = strings.TrimSuffix(legacy[:i], ".")
+			legacy = legacy[i:]
+		}
+		parts := strings.SplitN(strings.TrimPrefix(legacy, "provider."), ".", 2)
+		name = parts[0]
+		if len(parts) == 2 {
+			alias = parts[1]
+		}
+	}
+
+	return providerRef{module: moduleAddr, source: defaultProviderNamespace + "/" + name, alias: alias}.String()
+}
+
+// upgradeLegacyProviders upgrades the legacy provider references of the resources of a format version 4 state (written by v0.12),
+// which are absolute already, e.g. "module.a.provider.aws".
+func upgradeLegacyProviders(state map[string]interface{}) {
+	resources, _ := state["resources"].([]interface{})
+	for _, r := range resources {
+		res, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		provider, _ := res["provider"].(string)
+		if strings.Contains(provider, `provider["`) || !strings.HasPrefix(provider, "provider.") && !strings.Contains(provider, ".provider.") {
+			continue
+		}
+		typ, _ := res["type"].(string)
+		res["provider"] = upgradeProviderAddr("", typ, provider)
+	}
+}
+
+// upgradeDependency converts a legacy "depends_on" entry, which is relative to its module, to an absolute dependency.
+func upgradeDependency(moduleAddr, dep string) string {
+	// Strip the instance index, e.g. "aws_instance.foo.1"
+	parts := strings.Split(dep, ".")
+	if _, err := strconv.Atoi(parts[len(parts)-1]); err == nil {
+		parts = parts[:len(parts)-1]
+	}
+	dep = strings.Join(parts, ".")
+	if moduleAddr == "" {
+		return dep
+	}
+	return moduleAddr + "." + dep
+}
+
+// impliedType returns the JSON encoded cty type of an output value, in the way terraform records it.
+func impliedType(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	case []interface{}:
+		types := []interface{}{}
+		for _, e := range v {
+			types = append(types, impliedType(e))
+		}
+		return []interface{}{"tuple", types}
+	case map[string]interface{}:
+		types := map[string]interface{}{}
+		for k, e := range v {
+			types[k] = impliedType(e)
+		}
+		return []interface{}{"object", types}
+	default:
+		return "dynamic"
+	}
+}
+
+func stringOrEmpty(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,198 @@
+package tfmerge
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeStateV3(t *testing.T) {
+	input := `{
+"version": 3,
+"terraform_version": "0.11.14",
+"serial": 7,
+"lineage": "01cbbc6d-7e75-ebce-ff78-f5d9c03501ab",
+"modules": [
+  {
+    "path": ["root"],
+    "outputs": {
+      "ip": { "sensitive": false, "type": "string", "value": "10.0.0.1" }
+    },
+    "resources": {
+      "aws_instance.web": {
+        "type": "aws_instance",
+        "depends_on": ["aws_vpc.main"],
+        "primary": {
+          "id": "i-0",
+          "attributes": { "id": "i-0" },
+          "meta": { "schema_version": "1" },
+          "tainted": false
+        },
+        "provider": "provider.aws.west"
+      },
+      "aws_instance.web.1": {
+        "type": "aws_instance",
+        "depends_on": ["aws_vpc.main"],
+        "primary": {
+          "id": "i-1",
+          "attributes": { "id": "i-1" },
+          "meta": { "schema_version": "1" },
+          "tainted": true
+        },
+        "provider": "provider.aws.west"
+      }
+    }
+  },
+  {
+    "path": ["root", "network"],
+    "outputs": {
+      "ignored": { "sensitive": false, "type": "string", "value": "x" }
+    },
+    "resources": {
+      "aws_vpc.main": {
+        "type": "aws_vpc",
+        "depends_on": [],
+        "primary": {
+          "id": "vpc-0",
+          "attributes": { "id": "vpc-0" },
+          "meta": {},
+          "tainted": false
+        },
+        "deposed": [
+          { "id": "vpc-old", "attributes": { "id": "vpc-old" } }
+        ],
+        "provider": "provider.aws"
+      },
+      "data.aws_ami.ubuntu": {
+        "type": "aws_ami",
+        "depends_on": [],
+        "primary": { "id": "ami-0", "attributes": { "id": "ami-0" } },
+        "provider": ""
+      }
+    }
+  }
+]
+}`
+	expect := `{
+"version": 4,
+"terraform_version": "0.11.14",
+"serial": 7,
+"lineage": "01cbbc6d-7e75-ebce-ff78-f5d9c03501ab",
+"outputs": {
+  "ip": { "value": "10.0.0.1", "type": "string", "sensitive": false }
+},
+"resources": [
+  {
+    "mode": "managed",
+    "type": "aws_instance",
+    "name": "web",
+    "each": "list",
+    "provider": "provider[\"registry.terraform.io/hashicorp/aws\"].west",
+    "instances": [
+      {
+        "index_key": 0,
+        "schema_version": 1,
+        "attributes_flat": { "id": "i-0" },
+        "sensitive_attributes": [],
+        "dependencies": ["aws_vpc.main"]
+      },
+      {
+        "index_key": 1,
+        "status": "tainted",
+        "schema_version": 1,
+        "attributes_flat": { "id": "i-1" },
+        "sensitive_attributes": [],
+        "dependencies": ["aws_vpc.main"]
+      }
+    ]
+  },
+  {
+    "module": "module.network",
+    "mode": "managed",
+    "type": "aws_vpc",
+    "name": "main",
+    "provider": "module.network.provider[\"registry.terraform.io/hashicorp/aws\"]",
+    "instances": [
+      {
+        "schema_version": 0,
+        "attributes_flat": { "id": "vpc-0" },
+        "sensitive_attributes": [],
+        "dependencies": []
+      },
+      {
+        "deposed": "00000001",
+        "schema_version": 0,
+        "attributes_flat": { "id": "vpc-old" },
+        "sensitive_attributes": [],
+        "dependencies": []
+      }
+    ]
+  },
+  {
+    "module": "module.network",
+    "mode": "data",
+    "type": "aws_ami",
+    "name": "ubuntu",
+    "provider": "module.network.provider[\"registry.terraform.io/hashicorp/aws\"]",
+    "instances": [
+      {
+        "schema_version": 0,
+        "attributes_flat": { "id": "ami-0" },
+        "sensitive_attributes": [],
+        "dependencies": []
+      }
+    ]
+  }
+],
+"check_results": null
+}`
+
+	state, err := decodeState([]byte(input))
+	require.NoError(t, err)
+	actual, err := json.Marshal(state)
+	require.NoError(t, err)
+	require.JSONEq(t, expect, string(actual))
+}
+
+func TestDecodeStateUnsupportedVersion(t *testing.T) {
+	_, err := decodeState([]byte(`{"version": 2}`))
+	require.Error(t, err)
+	_, err = decodeState([]byte(`{"lineage": "x"}`))
+	require.ErrorContains(t, err, "missing state format version")
+	_, err = decodeState([]byte(`{"version": 4, "serial": "1"}`))
+	require.ErrorContains(t, err, "invalid state serial")
+}
+
+func TestUpgradeProviderAddr(t *testing.T) {
+	require.Equal(t, `provider["registry.terraform.io/hashicorp/aws"]`, upgradeProviderAddr("", "aws_instance", "provider.aws"))
+	require.Equal(t, `provider["registry.terraform.io/hashicorp/aws"].west`, upgradeProviderAddr("", "aws_instance", "provider.aws.west"))
+	require.Equal(t, `module.a.provider["registry.terraform.io/hashicorp/null"]`, upgradeProviderAddr("module.a", "null_resource", ""))
+	require.Equal(t, `module.a.provider["registry.terraform.io/hashicorp/aws"].east`, upgradeProviderAddr("module.a.module.b", "aws_instance", "module.a.provider.aws.east"))
+}
+
+func TestDecodeStateLegacyProviders(t *testing.T) {
+	// Written by terraform v0.12
+	state, err := decodeState([]byte(`{
+  "version": 4,
+  "terraform_version": "0.12.31",
+  "serial": 1,
+  "lineage": "aaaa",
+  "outputs": {},
+  "resources": [
+    {"mode": "managed", "type": "null_resource", "name": "a", "provider": "provider.null", "instances": []},
+    {"module": "module.x", "mode": "managed", "type": "aws_instance", "name": "b", "provider": "module.x.provider.aws.west", "instances": []},
+    {"mode": "managed", "type": "aws_instance", "name": "c", "provider": "provider[\"registry.terraform.io/hashicorp/aws\"]", "instances": []}
+  ]
+}`))
+	require.NoError(t, err)
+	var providers []interface{}
+	for _, res := range state["resources"].([]interface{}) {
+		providers = append(providers, res.(map[string]interface{})["provider"])
+	}
+	require.Equal(t, []interface{}{
+		`provider["registry.terraform.io/hashicorp/null"]`,
+		`module.x.provider["registry.terraform.io/hashicorp/aws"].west`,
+		`provider["registry.terraform.io/hashicorp/aws"]`,
+	}, providers)
+}
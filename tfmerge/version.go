@@ -0,0 +1,48 @@
+package tfmerge
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/go-version"
+)
+
+// ------------------| Terraform Version: FNs |------------------
+
+// highestTerraformVersion returns whichever of the two terraform versions is newer.
+// An empty version is treated as unknown and loses against any known version.
+func highestTerraformVersion(current, candidate string) (string, error) {
+	if candidate == "" {
+		return current, nil
+	}
+	cv, err := version.NewVersion(candidate)
+	if err != nil {
+		return "", fmt.Errorf("parsing terraform version %q: %v", candidate, err)
+	}
+	if current == "" {
+		return cv.String(), nil
+	}
+	v, err := version.NewVersion(current)
+	if err != nil {
+		return "", fmt.Errorf("parsing terraform version %q: %v", current, err)
+	}
+	if cv.GreaterThan(v) {
+		return cv.String(), nil
+	}
+	return v.String(), nil
+}
+
+// checkTerraformVersion errors if the state file was written by a terraform newer than max.
+// A nil max disables the check.
+func checkTerraformVersion(stateFile, tfVersion string, max *version.Version) error {
+	if max == nil || tfVersion == "" {
+		return nil
+	}
+	v, err := version.NewVersion(tfVersion)
+	if err != nil {
+		return fmt.Errorf("parsing terraform version %q of state file %s: %v", tfVersion, stateFile, err)
+	}
+	if v.GreaterThan(max) {
+		return fmt.Errorf("state file %s is written by terraform %s, which is newer than the maximum allowed version %s", stateFile, v, max)
+	}
+	return nil
+}
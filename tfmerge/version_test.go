@@ -0,0 +1,45 @@
+package tfmerge
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHighestTerraformVersion(t *testing.T) {
+	versionCases := []struct {
+		name      string
+		current   string
+		candidate string
+		expect    string
+		hasError  bool
+	}{
+		{name: "first version", current: "", candidate: "1.2.8", expect: "1.2.8"},
+		{name: "unknown candidate", current: "1.2.8", candidate: "", expect: "1.2.8"},
+		{name: "newer candidate", current: "1.2.8", candidate: "1.3.6", expect: "1.3.6"},
+		{name: "older candidate", current: "1.3.6", candidate: "1.2.8", expect: "1.3.6"},
+		{name: "not a string compare", current: "1.9.0", candidate: "1.10.0", expect: "1.10.0"},
+		{name: "invalid candidate", current: "1.2.8", candidate: "latest", hasError: true},
+	}
+
+	for _, tt := range versionCases {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := highestTerraformVersion(tt.current, tt.candidate)
+			if tt.hasError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, actual)
+		})
+	}
+}
+
+func TestCheckTerraformVersion(t *testing.T) {
+	max := version.Must(version.NewVersion("1.3.6"))
+	require.NoError(t, checkTerraformVersion("state", "1.3.6", max))
+	require.NoError(t, checkTerraformVersion("state", "1.2.7", max))
+	require.NoError(t, checkTerraformVersion("state", "1.5.0", nil))
+	require.Error(t, checkTerraformVersion("state", "1.4.0", max))
+}
@@ -0,0 +1,194 @@
+package tfmerge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+)
+
+// ------------------| Workspace: FNs |------------------
+
+const (
+	defaultWorkspace    = "default"
+	defaultStatePath    = "terraform.tfstate"
+	defaultWorkspaceDir = "terraform.tfstate.d"
+)
+
+// localBackend is the configuration of the local backend of a working directory, nil for the other backends
+type localBackend struct {
+	Path         string `json:"path"`
+	WorkspaceDir string `json:"workspace_dir"`
+}
+
+// readLocalBackend reads the backend that the working directory is initialized with, from .terraform/terraform.tfstate.
+// A working directory without a backend uses the local backend.
+func readLocalBackend(wd string) (*localBackend, error) {
+	var backend localBackend
+	b, err := os.ReadFile(filepath.Join(wd, ".terraform", "terraform.tfstate"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var backendState struct {
+			Backend *struct {
+				Type   string          `json:"type"`
+				Config json.RawMessage `json:"config"`
+			} `json:"backend"`
+		}
+		if err := json.Unmarshal(b, &backendState); err != nil {
+			return nil, fmt.Errorf("reading the backend of %s: %v", wd, err)
+		}
+		if backendState.Backend != nil {
+			if backendState.Backend.Type != "local" {
+				return nil, nil
+			}
+			if len(backendState.Backend.Config) != 0 {
+				if err := json.Unmarshal(backendState.Backend.Config, &backend); err != nil {
+					return nil, fmt.Errorf("reading the backend of %s: %v", wd, err)
+				}
+			}
+		}
+	}
+	if backend.Path == "" {
+		backend.Path = defaultStatePath
+	}
+	if backend.WorkspaceDir == "" {
+		backend.WorkspaceDir = defaultWorkspaceDir
+	}
+	return &backend, nil
+}
+
+// statePath is the state file of the workspace in the local backend, the relative paths of the configuration are relative to wd
+func (backend *localBackend) statePath(wd, workspace string) string {
+	path := filepath.Join(backend.WorkspaceDir, workspace, defaultStatePath)
+	if workspace == defaultWorkspace {
+		path = backend.Path
+	}
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(wd, path)
+}
+
+// selectedWorkspace is the workspace selected in the working directory, as terraform determines it
+func selectedWorkspace(wd string) (string, error) {
+	if v := os.Getenv("TF_WORKSPACE"); v != "" {
+		return v, nil
+	}
+	b, err := os.ReadFile(filepath.Join(wd, ".terraform", "environment"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return defaultWorkspace, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if ws := string(bytes.TrimSpace(b)); ws != "" {
+		return ws, nil
+	}
+	return defaultWorkspace, nil
+}
+
+// LocalStatePath returns the state file of the selected workspace of the working directory, if it uses the local backend.
+// It returns an empty string for the other backends.
+func LocalStatePath(wd string) (string, error) {
+	backend, err := readLocalBackend(wd)
+	if err != nil || backend == nil {
+		return "", err
+	}
+	ws, err := selectedWorkspace(wd)
+	if err != nil {
+		return "", err
+	}
+	return backend.statePath(wd, ws), nil
+}
+
+// WorkspaceStates collects the states of the workspaces of the working directory of tf, all of them if workspaces is empty.
+// The states of a local backend are opened from disk (to be read once they're unlocked, and closed by the caller),
+// the others are pulled workspace by workspace (the selected workspace is restored afterwards).
+// If asModules, the state of each workspace goes under module.<workspace>.
+func WorkspaceStates(ctx context.Context, tf *tfexec.Terraform, workspaces []string, asModules bool) (stateFiles []NamedReader, err error) {
+	existing, current, err := tf.WorkspaceList(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing the workspaces: %v", err)
+	}
+	if len(workspaces) == 0 {
+		workspaces = existing
+	}
+	known := make(map[string]bool)
+	for _, ws := range existing {
+		known[ws] = true
+	}
+	for _, ws := range workspaces {
+		if !known[ws] {
+			return nil, fmt.Errorf("workspace %q doesn't exist", ws)
+		}
+	}
+
+	backend, err := readLocalBackend(tf.WorkingDir())
+	if err != nil {
+		return nil, err
+	}
+	if backend == nil {
+		defer func() {
+			if serr := tf.WorkspaceSelect(ctx, current); serr != nil && err == nil {
+				err = fmt.Errorf("selecting back the workspace %q: %v", current, serr)
+			}
+		}()
+	}
+
+	defer func() {
+		if err != nil {
+			for _, sf := range stateFiles {
+				if f, ok := sf.Reader.(*os.File); ok {
+					f.Close()
+				}
+			}
+			stateFiles = nil
+		}
+	}()
+
+	for _, ws := range workspaces {
+		name := fmt.Sprintf("workspace %s", ws)
+		var r io.Reader
+		if backend != nil {
+			f, err := os.Open(backend.statePath(tf.WorkingDir(), ws))
+			if errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Skip workspace %s, it has no state yet", ws)
+				continue
+			}
+			if err != nil {
+				return stateFiles, fmt.Errorf("reading the state of workspace %s: %v", ws, err)
+			}
+			r = f
+		} else {
+			if err := tf.WorkspaceSelect(ctx, ws); err != nil {
+				return stateFiles, fmt.Errorf("selecting workspace %s: %v", ws, err)
+			}
+			state, err := tf.StatePull(ctx)
+			if err != nil {
+				return stateFiles, fmt.Errorf("pulling the state of workspace %s: %v", ws, err)
+			}
+			if len(bytes.TrimSpace([]byte(state))) == 0 {
+				log.Printf("Skip workspace %s, it has no state yet", ws)
+				continue
+			}
+			r = strings.NewReader(state)
+		}
+		stateFile := NamedReader{Name: name, Reader: r}
+		if asModules {
+			stateFile.Module = "module." + moduleName(ws)
+		}
+		stateFiles = append(stateFiles, stateFile)
+	}
+	return stateFiles, nil
+}
@@ -0,0 +1,52 @@
+package tfmerge
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadLocalBackend(t *testing.T) {
+	wd := t.TempDir()
+
+	// No backend configured: the default local backend
+	backend, err := readLocalBackend(wd)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(wd, "terraform.tfstate"), backend.statePath(wd, "default"))
+	require.Equal(t, filepath.Join(wd, "terraform.tfstate.d", "dev", "terraform.tfstate"), backend.statePath(wd, "dev"))
+
+	require.NoError(t, os.Mkdir(filepath.Join(wd, ".terraform"), 0755))
+	writeBackend := func(s string) {
+		require.NoError(t, os.WriteFile(filepath.Join(wd, ".terraform", "terraform.tfstate"), []byte(s), 0644))
+	}
+
+	writeBackend(`{"version": 3, "backend": {"type": "local", "config": {"path": "states/main.tfstate", "workspace_dir": "states"}}}`)
+	backend, err = readLocalBackend(wd)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(wd, "states", "main.tfstate"), backend.statePath(wd, "default"))
+	require.Equal(t, filepath.Join(wd, "states", "dev", "terraform.tfstate"), backend.statePath(wd, "dev"))
+
+	require.NoError(t, os.WriteFile(filepath.Join(wd, ".terraform", "environment"), []byte("dev"), 0644))
+	path, err := LocalStatePath(wd)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(wd, "states", "dev", "terraform.tfstate"), path)
+
+	// Absolute paths are kept
+	abs := t.TempDir()
+	writeBackend(fmt.Sprintf(`{"version": 3, "backend": {"type": "local", "config": {"path": %q, "workspace_dir": %q}}}`, filepath.Join(abs, "main.tfstate"), abs))
+	backend, err = readLocalBackend(wd)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(abs, "main.tfstate"), backend.statePath(wd, "default"))
+	require.Equal(t, filepath.Join(abs, "dev", "terraform.tfstate"), backend.statePath(wd, "dev"))
+
+	writeBackend(`{"version": 3, "backend": {"type": "s3", "config": {"bucket": "states"}}}`)
+	backend, err = readLocalBackend(wd)
+	require.NoError(t, err)
+	require.Nil(t, backend)
+	path, err = LocalStatePath(wd)
+	require.NoError(t, err)
+	require.Empty(t, path)
+}
@@ -0,0 +1,84 @@
+//go:build unix
+
+package tfmerge
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform-exec/tfexec"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTerraformScript lists the workspaces default, dev & prod (dev being selected), any other command fails
+const fakeTerraformScript = `#!/bin/sh
+if [ "$1 $2" = "workspace list" ]; then
+	printf '  default\n* dev\n  prod\n'
+	exit 0
+fi
+exit 1
+`
+
+func TestWorkspaceStatesLocal(t *testing.T) {
+	execPath := filepath.Join(t.TempDir(), "terraform")
+	require.NoError(t, os.WriteFile(execPath, []byte(fakeTerraformScript), 0700))
+	state := func(ws string) string {
+		return fmt.Sprintf(`{"version": 4, "serial": 1, "lineage": %q, "outputs": {}, "resources": []}`, ws)
+	}
+	read := func(stateFiles []NamedReader) map[string]string {
+		states := make(map[string]string)
+		for _, sf := range stateFiles {
+			b, err := io.ReadAll(sf.Reader)
+			require.NoError(t, err)
+			if c, ok := sf.Reader.(io.Closer); ok {
+				c.Close()
+			}
+			states[sf.Name] = string(b)
+		}
+		return states
+	}
+
+	for name, absolute := range map[string]bool{"relative": false, "absolute": true} {
+		t.Run(name, func(t *testing.T) {
+			wd := t.TempDir()
+			dir := "states"
+			if absolute {
+				dir = t.TempDir()
+			}
+			require.NoError(t, os.Mkdir(filepath.Join(wd, ".terraform"), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(wd, ".terraform", "terraform.tfstate"),
+				[]byte(fmt.Sprintf(`{"version": 3, "backend": {"type": "local", "config": {"path": %q, "workspace_dir": %q}}}`, filepath.Join(dir, "main.tfstate"), dir)), 0644))
+			abs := dir
+			if !absolute {
+				abs = filepath.Join(wd, dir)
+			}
+			// prod has no state yet
+			require.NoError(t, os.MkdirAll(filepath.Join(abs, "dev"), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(abs, "main.tfstate"), []byte(state("default")), 0600))
+			require.NoError(t, os.WriteFile(filepath.Join(abs, "dev", "terraform.tfstate"), []byte(state("dev")), 0600))
+
+			tf, err := tfexec.NewTerraform(wd, execPath)
+			require.NoError(t, err)
+			stateFiles, err := WorkspaceStates(context.Background(), tf, nil, false)
+			require.NoError(t, err)
+			require.Equal(t, map[string]string{"workspace default": state("default"), "workspace dev": state("dev")}, read(stateFiles))
+
+			// The state files are opened, to be read once they're unlocked
+			stateFiles, err = WorkspaceStates(context.Background(), tf, []string{"dev"}, true)
+			require.NoError(t, err)
+			require.Len(t, stateFiles, 1)
+			require.Equal(t, "module.dev", stateFiles[0].Module)
+			f, ok := stateFiles[0].Reader.(*os.File)
+			require.True(t, ok)
+			require.Equal(t, filepath.Join(abs, "dev", "terraform.tfstate"), f.Name())
+			read(stateFiles)
+
+			_, err = WorkspaceStates(context.Background(), tf, []string{"staging"}, false)
+			require.ErrorContains(t, err, `workspace "staging" doesn't exist`)
+		})
+	}
+}